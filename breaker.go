@@ -0,0 +1,367 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultBreakerErrorRatio  = 0.5
+	defaultBreakerMinRequests = 20
+	defaultBreakerWindow      = 10 * time.Second
+	defaultBreakerCooldown    = 30 * time.Second
+	defaultStaleMaxObjectSize = 1 << 20
+)
+
+const (
+	breakerStateClosed   = "closed"
+	breakerStateOpen     = "open"
+	breakerStateHalfOpen = "half-open"
+)
+
+// The Warning header of responses served from the stale cache
+const staleWarning = `110 - "Response is Stale"`
+
+// CircuitBreakerConfig makes requests to a bucket fail fast while S3 is failing or slow.
+type CircuitBreakerConfig struct {
+	// Share of failed or slow S3 requests in a window that opens the breaker. Default is 0.5.
+	ErrorRatio float64 `json:"error_ratio,omitempty"`
+
+	// S3 requests slower than this count as failed. 0 means latency is not looked at.
+	Latency caddy.Duration `json:"latency,omitempty"`
+
+	// Fewest S3 requests in a window before the breaker can open. Default is 20.
+	MinRequests int `json:"min_requests,omitempty"`
+
+	// Length of the window requests are counted in. Default is 10s.
+	Window caddy.Duration `json:"window,omitempty"`
+
+	// How long the breaker stays open before a request is let through to try S3 again. Default is 30s.
+	Cooldown caddy.Duration `json:"cooldown,omitempty"`
+
+	// Bytes of recently served objects kept in memory to serve (stale) while the breaker is open
+	// or S3 fails. 0 disables it.
+	StaleCacheSize int64 `json:"stale_cache_size,omitempty"`
+
+	// Objects larger than this are not kept for serving stale. Default is 1MiB.
+	StaleMaxObjectSize int64 `json:"stale_max_object_size,omitempty"`
+}
+
+// BreakerStatus is the state of the breaker of one bucket.
+type BreakerStatus struct {
+	State     string     `json:"state"`
+	Requests  int        `json:"requests"`
+	Failures  int        `json:"failures"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+// breaker counts the S3 requests to one bucket in fixed windows
+type breaker struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	failures    int
+	open        bool
+	openUntil   time.Time
+
+	// When the request trying S3 again was let through, zero if there is none
+	probeStart time.Time
+}
+
+// breakerSet holds the breaker of every bucket, and the stale cache
+type breakerSet struct {
+	config CircuitBreakerConfig
+	stale  *staleCache
+	log    *zap.Logger
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+func newBreakerSet(config CircuitBreakerConfig, log *zap.Logger) *breakerSet {
+	if config.ErrorRatio <= 0 {
+		config.ErrorRatio = defaultBreakerErrorRatio
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = defaultBreakerMinRequests
+	}
+	if config.Window <= 0 {
+		config.Window = caddy.Duration(defaultBreakerWindow)
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = caddy.Duration(defaultBreakerCooldown)
+	}
+	if config.StaleMaxObjectSize <= 0 {
+		config.StaleMaxObjectSize = defaultStaleMaxObjectSize
+	}
+
+	s := &breakerSet{
+		config:   config,
+		log:      log,
+		breakers: make(map[string]*breaker),
+	}
+	if config.StaleCacheSize > 0 {
+		s.stale = newStaleCache(config.StaleCacheSize, config.StaleMaxObjectSize)
+	}
+	return s
+}
+
+func (s *breakerSet) get(bucket string) *breaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.breakers[bucket]
+	if !ok {
+		b = &breaker{windowStart: time.Now()}
+		s.breakers[bucket] = b
+	}
+	return b
+}
+
+// allow returns true if a request to bucket may go to S3. Once the cooldown is over one request
+// is let through (and the cooldown restarted), the result of that request closes or reopens the breaker.
+func (s *breakerSet) allow(bucket string) bool {
+	b := s.get(bucket)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(time.Duration(s.config.Cooldown))
+	b.probeStart = now
+	return true
+}
+
+// record counts the outcome of one S3 request, started at started
+func (s *breakerSet) record(bucket string, failed bool, started time.Time, latency time.Duration) {
+	if s.config.Latency > 0 && latency > time.Duration(s.config.Latency) {
+		failed = true
+	}
+
+	b := s.get(bucket)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.open {
+		// Only the request let through after the cooldown decides, not the ones that were
+		// already running when the breaker opened
+		if b.probeStart.IsZero() || started.Before(b.probeStart) {
+			return
+		}
+		if failed {
+			b.openUntil = now.Add(time.Duration(s.config.Cooldown))
+			b.probeStart = time.Time{}
+			return
+		}
+		b.open = false
+		b.probeStart = time.Time{}
+		b.windowStart, b.requests, b.failures = now, 0, 0
+		s.log.Info("circuit breaker closed", zap.String("bucket", bucket))
+		return
+	}
+
+	if now.Sub(b.windowStart) > time.Duration(s.config.Window) {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if b.requests >= s.config.MinRequests && float64(b.failures)/float64(b.requests) >= s.config.ErrorRatio {
+		b.open = true
+		b.openUntil = now.Add(time.Duration(s.config.Cooldown))
+		s.log.Warn("circuit breaker opened",
+			zap.String("bucket", bucket),
+			zap.Int("requests", b.requests),
+			zap.Int("failures", b.failures),
+			zap.Time("open_until", b.openUntil),
+		)
+	}
+}
+
+// retryAfter returns how long until the breaker of bucket lets a request through
+func (s *breakerSet) retryAfter(bucket string) time.Duration {
+	b := s.get(bucket)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Until(b.openUntil)
+}
+
+// status returns the state of every breaker
+func (s *breakerSet) status() map[string]BreakerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	statuses := make(map[string]BreakerStatus, len(s.breakers))
+	for bucket, b := range s.breakers {
+		b.mu.Lock()
+		status := BreakerStatus{
+			State:    breakerStateClosed,
+			Requests: b.requests,
+			Failures: b.failures,
+		}
+		if b.open {
+			openUntil := b.openUntil.UTC()
+			status.OpenUntil = &openUntil
+			status.State = breakerStateOpen
+			if !now.Before(b.openUntil) {
+				status.State = breakerStateHalfOpen
+			}
+		}
+		b.mu.Unlock()
+		statuses[bucket] = status
+	}
+	return statuses
+}
+
+// recordRequest is a Complete handler counting every S3 request made with the session
+func (s *breakerSet) recordRequest(r *request.Request) {
+	values, _ := awsutil.ValuesAtPath(r.Params, "Bucket")
+	if len(values) == 0 {
+		return
+	}
+	bucket, ok := values[0].(*string)
+	if !ok || bucket == nil {
+		return
+	}
+
+	if requestCanceled(r) {
+		return
+	}
+	s.record(*bucket, requestFailed(r), r.Time, time.Since(r.Time))
+}
+
+// circuitOpenError sets Retry-After and returns the 503 of a request refused by an open breaker
+func (p S3Proxy) circuitOpenError(w http.ResponseWriter) error {
+	seconds := int(math.Ceil(p.breakers.retryAfter(p.Bucket).Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return caddyhttp.Error(http.StatusServiceUnavailable, errors.New("circuit breaker open for bucket "+p.Bucket))
+}
+
+// staleCache keeps recently served small objects, least recently used ones are dropped first
+type staleCache struct {
+	maxSize       int64
+	maxObjectSize int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type staleObject struct {
+	key  string
+	obj  s3.GetObjectOutput
+	body []byte
+}
+
+func newStaleCache(maxSize int64, maxObjectSize int64) *staleCache {
+	return &staleCache{
+		maxSize:       maxSize,
+		maxObjectSize: maxObjectSize,
+		order:         list.New(),
+		entries:       make(map[string]*list.Element),
+	}
+}
+
+// keep reads the body of obj if it is small enough to be kept and returns an object
+// that can still be served
+func (c *staleCache) keep(key string, obj *s3.GetObjectOutput) (*s3.GetObjectOutput, error) {
+	if obj.Body == nil || obj.ContentLength == nil || *obj.ContentLength > c.maxObjectSize || *obj.ContentLength > c.maxSize {
+		return obj, nil
+	}
+	body, err := ioutil.ReadAll(obj.Body)
+	obj.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &staleObject{key: key, obj: *obj, body: body}
+	entry.obj.Body = nil
+
+	c.mu.Lock()
+	if old, ok := c.entries[key]; ok {
+		c.size -= int64(len(old.Value.(*staleObject).body))
+		c.order.Remove(old)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	c.size += int64(len(body))
+	for c.size > c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*staleObject).key)
+		c.size -= int64(len(oldest.Value.(*staleObject).body))
+	}
+	c.mu.Unlock()
+
+	served := entry.obj
+	served.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return &served, nil
+}
+
+// get returns a copy of the kept object, or nil
+func (c *staleCache) get(key string) *s3.GetObjectOutput {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	entry := elem.Value.(*staleObject)
+	obj := entry.obj
+	obj.Body = ioutil.NopCloser(bytes.NewReader(entry.body))
+	return &obj
+}
+
+// keepStale keeps obj for serving stale later, if the stale cache is on
+func (p S3Proxy) keepStale(r *http.Request, fullPath string, obj *s3.GetObjectOutput) (*s3.GetObjectOutput, error) {
+	if p.breakers == nil || p.breakers.stale == nil || r.Header.Get("Range") != "" {
+		return obj, nil
+	}
+	return p.breakers.stale.keep(p.Bucket+"|"+fullPath, obj)
+}
+
+// serveStale serves a kept copy of fullPath after S3 failed. It returns false if there is none.
+func (p S3Proxy) serveStale(w http.ResponseWriter, fullPath string, cause error) (bool, error) {
+	if p.breakers == nil || p.breakers.stale == nil {
+		return false, nil
+	}
+	obj := p.breakers.stale.get(p.Bucket + "|" + fullPath)
+	if obj == nil {
+		return false, nil
+	}
+
+	p.log.Warn("serving stale object",
+		zap.String("bucket", p.Bucket),
+		zap.String("key", fullPath),
+		zap.String("err", cause.Error()),
+	)
+	w.Header().Set("Warning", staleWarning)
+	return true, p.writeResponseFromGetObject(w, obj)
+}
@@ -0,0 +1,189 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestBreaker(t *testing.T) {
+	breakers := newBreakerSet(CircuitBreakerConfig{
+		ErrorRatio:  0.5,
+		MinRequests: 4,
+		Latency:     caddy.Duration(time.Second),
+		Cooldown:    caddy.Duration(50 * time.Millisecond),
+	}, zap.NewNop())
+
+	breakers.record("bkt", false, time.Now(), time.Millisecond)
+	breakers.record("bkt", true, time.Now(), time.Millisecond)
+	breakers.record("bkt", false, time.Now(), 2*time.Second)
+	if !breakers.allow("bkt") {
+		t.Fatal("Expected the breaker to stay closed below min_requests")
+	}
+	breakers.record("bkt", false, time.Now(), time.Millisecond)
+	if breakers.allow("bkt") {
+		t.Fatal("Expected the breaker to open")
+	}
+	if !breakers.allow("other") {
+		t.Error("Expected the breaker of another bucket to be closed")
+	}
+	if state := breakers.status()["bkt"].State; state != breakerStateOpen {
+		t.Errorf("Expected state %s, got %s", breakerStateOpen, state)
+	}
+
+	// After the cooldown only one request goes through
+	inFlight := time.Now()
+	time.Sleep(60 * time.Millisecond)
+	if !breakers.allow("bkt") {
+		t.Fatal("Expected a request to be let through after the cooldown")
+	}
+	if breakers.allow("bkt") {
+		t.Fatal("Expected only one request to be let through")
+	}
+	// A request started before the probe does not close the breaker
+	breakers.record("bkt", false, inFlight, time.Millisecond)
+	if breakers.allow("bkt") {
+		t.Fatal("Expected only the probe to close the breaker")
+	}
+	breakers.record("bkt", false, time.Now(), time.Millisecond)
+	if !breakers.allow("bkt") {
+		t.Error("Expected the breaker to close after a good request")
+	}
+}
+
+func TestBreakerIgnoresCanceled(t *testing.T) {
+	breakers := newBreakerSet(CircuitBreakerConfig{MinRequests: 2}, zap.NewNop())
+
+	for i := 0; i < 5; i++ {
+		breakers.recordRequest(&request.Request{
+			Params: &s3.GetObjectInput{Bucket: aws.String("bkt")},
+			Time:   time.Now(),
+			Error:  awserr.New(request.CanceledErrorCode, "request context canceled", context.Canceled),
+		})
+	}
+	if !breakers.allow("bkt") {
+		t.Error("Expected canceled requests not to open the breaker")
+	}
+	if requests := breakers.status()["bkt"].Requests; requests != 0 {
+		t.Errorf("Expected canceled requests not to be counted, got %d", requests)
+	}
+}
+
+func TestStaleCache(t *testing.T) {
+	cache := newStaleCache(10, 6)
+
+	keep := func(key string, content string) {
+		obj := &s3.GetObjectOutput{
+			ContentLength: aws.Int64(int64(len(content))),
+			Body:          ioutil.NopCloser(bytes.NewReader([]byte(content))),
+		}
+		obj, err := cache.keep(key, obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, _ := ioutil.ReadAll(obj.Body); string(body) != content {
+			t.Errorf("Expected the returned body to be %q, got %q", content, body)
+		}
+	}
+
+	keep("a", "aaaa")
+	keep("b", "bbbb")
+	keep("big", "1234567")
+	cache.get("a")
+	keep("c", "cccc")
+
+	for key, kept := range map[string]bool{"a": true, "b": false, "c": true, "big": false} {
+		if got := cache.get(key) != nil; got != kept {
+			t.Errorf("Expected %s kept to be %v", key, kept)
+		}
+	}
+}
+
+func TestCircuitBreakerOpen(t *testing.T) {
+	client := newS3Client(t)
+	bucketName := setupTestBucket(t, client)
+
+	// Forwards to S3 until failing is set
+	endpoint, err := url.Parse(client.Endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forward := httputil.NewSingleHostReverseProxy(endpoint)
+	var failing int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		forward.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+
+	proxy := S3Proxy{
+		Bucket:     bucketName,
+		HealthPath: "/healthz",
+		CircuitBreaker: &CircuitBreakerConfig{
+			MinRequests:    2,
+			Cooldown:       caddy.Duration(time.Minute),
+			StaleCacheSize: 1 << 20,
+		},
+		log: zap.NewExample(),
+	}
+	proxy.breakers = newBreakerSet(*proxy.CircuitBreaker, proxy.log)
+	proxy.health = newHealthCache(time.Minute)
+	sess := newStubSession(t, flaky.URL)
+	sess.Handlers.Complete.PushBack(proxy.breakers.recordRequest)
+	proxy.client = s3.New(sess)
+
+	serve := func(method string, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		recorder := httptest.NewRecorder()
+		_ = proxy.ServeHTTP(recorder, req, nil)
+		return recorder
+	}
+
+	if resp := serve(http.MethodGet, "/test.json"); resp.Code != http.StatusOK {
+		t.Fatalf("Expected code %d, got %d", http.StatusOK, resp.Code)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	serve(http.MethodGet, "/_404.txt")
+
+	resp := serve(http.MethodDelete, "/test.json")
+	if resp.Code != http.StatusServiceUnavailable || resp.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a 503 with Retry-After, got %d %v", resp.Code, resp.Header())
+	}
+
+	resp = serve(http.MethodGet, "/test.json")
+	if resp.Code != http.StatusOK || resp.Header().Get("Warning") != staleWarning {
+		t.Errorf("Expected a stale copy, got %d %v", resp.Code, resp.Header())
+	}
+
+	resp = serve(http.MethodGet, "/healthz")
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected health to be %d, got %d", http.StatusServiceUnavailable, resp.Code)
+	}
+	var health HealthStatus
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	if health.Breakers[bucketName].State != breakerStateOpen {
+		t.Errorf("Expected the breaker to be open, got %+v", health)
+	}
+}
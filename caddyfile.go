@@ -3,9 +3,12 @@ package caddys3proxy
 import (
 	"strconv"
 
+	caddy "github.com/caddyserver/caddy/v2"
+
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 )
 
 func init() {
@@ -19,12 +22,94 @@ func init() {
 //        root   <path to prefix S3 key with>
 //        region <aws region>
 //        profile <aws profile>
+//        credentials {
+//            access_key              <access key id> <secret access key> [<session token>]
+//            role_arn                <role arn>
+//            external_id             <external id>
+//            session_name            <session name>
+//            duration                <duration>
+//            web_identity_token_file <path>
+//            anonymous
+//        }
+//        transport {
+//            max_idle_conns           <count>
+//            max_idle_conns_per_host  <count>
+//            idle_timeout             <duration>
+//            dial_timeout             <duration>
+//            response_header_timeout  <duration>
+//            tls_ca                   <pem files...>
+//            tls_server_name          <name>
+//            tls_min_version          1.2|1.3
+//            tls_insecure_skip_verify
+//            proxy                    <url>
+//            versions                 <1.1|2...>
+//            dual_stack
+//            fips
+//        }
 //        bucket <s3 bucket name>
 //        index  <files...>
 //        hide   <file patterns...>
-//        endpoint <alternative endpoint>
+//        endpoint <alternative endpoints...> {
+//            policy    round_robin|least_latency|random
+//            max_fails <count>
+//            cooldown  <duration>
+//        }
 //        enable_put
 //        enable_delete
+//        enable_form_upload
+//        tus [<state key prefix>]
+//        deploy [<concurrency>] [<max archive size>] [<max extracted size>]
+//        sync
+//        content_addressed [<key template>]
+//        overlay <bucket> [<key prefix>]
+//        replica {
+//            bucket   <s3 bucket name>
+//            region   <aws region>
+//            endpoint <alternative endpoint>
+//            timeout  <duration>
+//        }
+//        hedge [<delay>] [<budget>]
+//        chunk_cache <cache size> [<chunk size>]
+//        not_found_cache [<ttl>] [<max entries>]
+//        parallel_get {
+//            threshold   <size>
+//            part_size   <size>
+//            concurrency <count>
+//        }
+//        circuit_breaker {
+//            error_ratio  <0 to 1>
+//            latency      <duration>
+//            min_requests <count>
+//            window       <duration>
+//            cooldown     <duration>
+//            stale        <cache size> [<max object size>]
+//        }
+//        health <path> {
+//            canary   <key>
+//            interval <duration>
+//        }
+//        startup_probe [list]
+//        origin <base url> [<timeout>]
+//        presign <path> {
+//            token         <bearer tokens...>
+//            allow         <key prefixes...>
+//            expiry        <duration>
+//            content_types <content types...>
+//            max_size      <bytes>
+//        }
+//        signed_urls {
+//            key          <id> <secret>
+//            issue_path   <path>
+//            admin_token  <bearer tokens...>
+//            max_expiry   <duration>
+//            state_prefix <key prefix>
+//        }
+//        hosts {
+//            map      <host pattern> <key prefix>
+//            fallback <key prefix>
+//            reject   <host patterns...>
+//        }
+//        release_pointer <pointer key> [<ttl>]
 //        force_path_style
 //        use_accelerate
 //        errors [<http code>] [<s3 key to error page>|pass_through]
@@ -43,8 +128,44 @@ parseLoop:
 	for h.NextBlock(0) {
 		switch h.Val() {
 		case "endpoint":
-			if !h.AllArgs(&b.Endpoint) {
+			endpoints := h.RemainingArgs()
+			switch len(endpoints) {
+			case 0:
 				return nil, h.ArgErr()
+			case 1:
+				b.Endpoint = endpoints[0]
+			default:
+				b.Endpoints = endpoints
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "policy":
+					if !h.AllArgs(&b.EndpointPolicy) {
+						return nil, h.ArgErr()
+					}
+				case "max_fails":
+					var maxFails string
+					if !h.AllArgs(&maxFails) {
+						return nil, h.ArgErr()
+					}
+					n, err := strconv.Atoi(maxFails)
+					if err != nil || n < 1 {
+						return nil, h.Errf("max_fails '%s' is not a valid count", maxFails)
+					}
+					b.EndpointMaxFails = n
+				case "cooldown":
+					var cooldown string
+					if !h.AllArgs(&cooldown) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(cooldown)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid duration", cooldown)
+					}
+					b.EndpointCooldown = caddy.Duration(dur)
+				default:
+					return nil, h.Errf("%s not a valid endpoint option", h.Val())
+				}
 			}
 		case "region":
 			if !h.AllArgs(&b.Region) {
@@ -79,10 +200,233 @@ parseLoop:
 			b.EnablePut = true
 		case "enable_delete":
 			b.EnableDelete = true
+		case "enable_form_upload":
+			b.EnableFormUpload = true
+		case "tus":
+			b.EnableTus = true
+			args := h.RemainingArgs()
+			if len(args) == 1 {
+				b.TusStatePrefix = args[0]
+			}
+			if len(args) > 1 {
+				return nil, h.ArgErr()
+			}
 		case "force_path_style":
 			b.S3ForcePathStyle = true
 		case "use_accelerate":
 			b.S3UseAccelerate = true
+		case "deploy":
+			b.EnableDeploy = true
+			args := h.RemainingArgs()
+			if len(args) > 3 {
+				return nil, h.ArgErr()
+			}
+			if len(args) >= 1 {
+				concurrency, err := strconv.Atoi(args[0])
+				if err != nil || concurrency < 1 {
+					return nil, h.Errf("'%s' is not a valid deploy concurrency", args[0])
+				}
+				b.DeployConcurrency = concurrency
+			}
+			if len(args) >= 2 {
+				size, err := humanize.ParseBytes(args[1])
+				if err != nil || size == 0 {
+					return nil, h.Errf("'%s' is not a valid size", args[1])
+				}
+				b.DeployMaxSize = int64(size)
+			}
+			if len(args) == 3 {
+				size, err := humanize.ParseBytes(args[2])
+				if err != nil || size == 0 {
+					return nil, h.Errf("'%s' is not a valid size", args[2])
+				}
+				b.DeployMaxExtract = int64(size)
+			}
+		case "sync":
+			b.EnableSync = true
+		case "content_addressed":
+			b.EnableContentAddressed = true
+			args := h.RemainingArgs()
+			if len(args) == 1 {
+				b.ContentAddressedKey = args[0]
+			}
+			if len(args) > 1 {
+				return nil, h.ArgErr()
+			}
+		case "overlay":
+			var overlay OverlaySource
+			args := h.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			overlay.Bucket = args[0]
+			if len(args) == 2 {
+				overlay.Prefix = args[1]
+			}
+			b.Overlays = append(b.Overlays, overlay)
+		case "credentials":
+			credentials, err := parseCredentials(h)
+			if err != nil {
+				return nil, err
+			}
+			b.Credentials = credentials
+		case "transport":
+			transport, err := parseTransport(h)
+			if err != nil {
+				return nil, err
+			}
+			b.Transport = transport
+		case "replica":
+			replica, err := parseReplica(h)
+			if err != nil {
+				return nil, err
+			}
+			b.Replica = replica
+		case "parallel_get":
+			parallelGet, err := parseParallelGet(h)
+			if err != nil {
+				return nil, err
+			}
+			b.ParallelGet = parallelGet
+		case "chunk_cache":
+			args := h.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			b.ChunkCache = &ChunkCacheConfig{}
+			size, err := humanize.ParseBytes(args[0])
+			if err != nil || size == 0 {
+				return nil, h.Errf("'%s' is not a valid size", args[0])
+			}
+			b.ChunkCache.Size = int64(size)
+			if len(args) > 1 {
+				chunkSize, err := humanize.ParseBytes(args[1])
+				if err != nil || chunkSize == 0 {
+					return nil, h.Errf("'%s' is not a valid size", args[1])
+				}
+				b.ChunkCache.ChunkSize = int64(chunkSize)
+			}
+		case "not_found_cache":
+			args := h.RemainingArgs()
+			if len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			b.NotFoundCache = &NotFoundCacheConfig{}
+			if len(args) > 0 {
+				dur, err := caddy.ParseDuration(args[0])
+				if err != nil || dur <= 0 {
+					return nil, h.Errf("'%s' is not a valid duration", args[0])
+				}
+				b.NotFoundCache.TTL = caddy.Duration(dur)
+			}
+			if len(args) > 1 {
+				maxEntries, err := strconv.Atoi(args[1])
+				if err != nil || maxEntries <= 0 {
+					return nil, h.Errf("'%s' is not a valid number of entries", args[1])
+				}
+				b.NotFoundCache.MaxEntries = maxEntries
+			}
+		case "hedge":
+			args := h.RemainingArgs()
+			if len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			b.Hedge = &HedgeConfig{}
+			if len(args) > 0 {
+				dur, err := caddy.ParseDuration(args[0])
+				if err != nil {
+					return nil, h.Errf("'%s' is not a valid duration", args[0])
+				}
+				b.Hedge.Delay = caddy.Duration(dur)
+			}
+			if len(args) > 1 {
+				budget, err := strconv.ParseFloat(args[1], 64)
+				if err != nil || budget <= 0 || budget > 1 {
+					return nil, h.Errf("hedge budget '%s' must be between 0 and 1", args[1])
+				}
+				b.Hedge.Budget = budget
+			}
+		case "circuit_breaker":
+			circuitBreaker, err := parseCircuitBreaker(h)
+			if err != nil {
+				return nil, err
+			}
+			b.CircuitBreaker = circuitBreaker
+		case "health":
+			if !h.AllArgs(&b.HealthPath) {
+				return nil, h.ArgErr()
+			}
+			for nesting := h.Nesting(); h.NextBlock(nesting); {
+				switch h.Val() {
+				case "canary":
+					if !h.AllArgs(&b.HealthCanary) {
+						return nil, h.ArgErr()
+					}
+				case "interval":
+					var interval string
+					if !h.AllArgs(&interval) {
+						return nil, h.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(interval)
+					if err != nil {
+						return nil, h.Errf("'%s' is not a valid duration", interval)
+					}
+					b.HealthInterval = caddy.Duration(dur)
+				default:
+					return nil, h.Errf("%s not a valid health option", h.Val())
+				}
+			}
+		case "startup_probe":
+			b.StartupProbe = true
+			args := h.RemainingArgs()
+			if len(args) > 1 || (len(args) == 1 && args[0] != "list") {
+				return nil, h.ArgErr()
+			}
+			b.StartupProbeList = len(args) == 1
+		case "origin":
+			args := h.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			b.Origin = args[0]
+			if len(args) > 1 {
+				dur, err := caddy.ParseDuration(args[1])
+				if err != nil || dur <= 0 {
+					return nil, h.Errf("'%s' is not a valid duration", args[1])
+				}
+				b.OriginTimeout = caddy.Duration(dur)
+			}
+		case "presign":
+			presign, err := parsePresign(h)
+			if err != nil {
+				return nil, err
+			}
+			b.Presign = presign
+		case "signed_urls":
+			signedURLs, err := parseSignedURLs(h)
+			if err != nil {
+				return nil, err
+			}
+			b.SignedURLs = signedURLs
+		case "hosts":
+			hostPrefixes, err := parseHostPrefixes(h)
+			if err != nil {
+				return nil, err
+			}
+			b.HostPrefixes = hostPrefixes
+		case "release_pointer":
+			args := h.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			b.ReleasePointer = args[0]
+			if len(args) == 2 {
+				ttl, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return nil, h.Errf("'%s' is not a valid duration", args[1])
+				}
+				b.ReleasePointerTTL = caddy.Duration(ttl)
+			}
 		case "browse":
 			b.EnableBrowse = true
 			args := h.RemainingArgs()
@@ -123,3 +467,425 @@ parseLoop:
 
 	return &b, nil
 }
+
+func parsePresign(h *caddyfile.Dispenser) (*PresignConfig, error) {
+	var c PresignConfig
+
+	if !h.AllArgs(&c.Path) {
+		return nil, h.ArgErr()
+	}
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "token":
+			c.Tokens = append(c.Tokens, h.RemainingArgs()...)
+			if len(c.Tokens) == 0 {
+				return nil, h.ArgErr()
+			}
+		case "allow":
+			c.AllowPrefixes = append(c.AllowPrefixes, h.RemainingArgs()...)
+			if len(c.AllowPrefixes) == 0 {
+				return nil, h.ArgErr()
+			}
+		case "content_types":
+			c.ContentTypes = append(c.ContentTypes, h.RemainingArgs()...)
+			if len(c.ContentTypes) == 0 {
+				return nil, h.ArgErr()
+			}
+		case "expiry":
+			var expiry string
+			if !h.AllArgs(&expiry) {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(expiry)
+			if err != nil {
+				return nil, h.Errf("'%s' is not a valid duration", expiry)
+			}
+			c.Expiry = caddy.Duration(dur)
+		case "max_size":
+			var maxSize string
+			if !h.AllArgs(&maxSize) {
+				return nil, h.ArgErr()
+			}
+			size, err := humanize.ParseBytes(maxSize)
+			if err != nil {
+				return nil, h.Errf("'%s' is not a valid size", maxSize)
+			}
+			c.MaxSize = int64(size)
+		default:
+			return nil, h.Errf("%s not a valid presign option", h.Val())
+		}
+	}
+
+	return &c, nil
+}
+
+func parseCredentials(h *caddyfile.Dispenser) (*CredentialsConfig, error) {
+	var c CredentialsConfig
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "access_key":
+			args := h.RemainingArgs()
+			if len(args) < 2 || len(args) > 3 {
+				return nil, h.ArgErr()
+			}
+			c.AccessKeyID = args[0]
+			c.SecretAccessKey = args[1]
+			if len(args) == 3 {
+				c.SessionToken = args[2]
+			}
+		case "role_arn":
+			if !h.AllArgs(&c.RoleARN) {
+				return nil, h.ArgErr()
+			}
+		case "external_id":
+			if !h.AllArgs(&c.ExternalID) {
+				return nil, h.ArgErr()
+			}
+		case "session_name":
+			if !h.AllArgs(&c.SessionName) {
+				return nil, h.ArgErr()
+			}
+		case "duration":
+			var duration string
+			if !h.AllArgs(&duration) {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(duration)
+			if err != nil {
+				return nil, h.Errf("'%s' is not a valid duration", duration)
+			}
+			c.Duration = caddy.Duration(dur)
+		case "web_identity_token_file":
+			if !h.AllArgs(&c.WebIdentityTokenFile) {
+				return nil, h.ArgErr()
+			}
+		case "anonymous":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			c.Anonymous = true
+		default:
+			return nil, h.Errf("%s not a valid credentials option", h.Val())
+		}
+	}
+
+	return &c, nil
+}
+
+func parseTransport(h *caddyfile.Dispenser) (*TransportConfig, error) {
+	var c TransportConfig
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "max_idle_conns", "max_idle_conns_per_host":
+			option := h.Val()
+			var count string
+			if !h.AllArgs(&count) {
+				return nil, h.ArgErr()
+			}
+			n, err := strconv.Atoi(count)
+			if err != nil || n < 0 {
+				return nil, h.Errf("%s '%s' is not a valid count", option, count)
+			}
+			if option == "max_idle_conns" {
+				c.MaxIdleConns = n
+			} else {
+				c.MaxIdleConnsPerHost = n
+			}
+		case "idle_timeout", "dial_timeout", "response_header_timeout":
+			option := h.Val()
+			var duration string
+			if !h.AllArgs(&duration) {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(duration)
+			if err != nil {
+				return nil, h.Errf("'%s' is not a valid duration", duration)
+			}
+			switch option {
+			case "idle_timeout":
+				c.IdleTimeout = caddy.Duration(dur)
+			case "dial_timeout":
+				c.DialTimeout = caddy.Duration(dur)
+			default:
+				c.ResponseHeaderTimeout = caddy.Duration(dur)
+			}
+		case "tls_ca":
+			c.TLSCAFiles = append(c.TLSCAFiles, h.RemainingArgs()...)
+			if len(c.TLSCAFiles) == 0 {
+				return nil, h.ArgErr()
+			}
+		case "tls_server_name":
+			if !h.AllArgs(&c.TLSServerName) {
+				return nil, h.ArgErr()
+			}
+		case "tls_min_version":
+			if !h.AllArgs(&c.TLSMinVersion) {
+				return nil, h.ArgErr()
+			}
+			if _, ok := tlsVersions[c.TLSMinVersion]; !ok {
+				return nil, h.Errf("'%s' is not a valid TLS version", c.TLSMinVersion)
+			}
+		case "tls_insecure_skip_verify":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			c.TLSInsecureSkipVerify = true
+		case "proxy":
+			if !h.AllArgs(&c.Proxy) {
+				return nil, h.ArgErr()
+			}
+		case "versions":
+			c.Versions = h.RemainingArgs()
+			if len(c.Versions) == 0 {
+				return nil, h.ArgErr()
+			}
+			for _, version := range c.Versions {
+				if version != "1.1" && version != "2" {
+					return nil, h.Errf("'%s' is not a valid HTTP version", version)
+				}
+			}
+		case "dual_stack":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			c.DualStack = true
+		case "fips":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			c.FIPS = true
+		default:
+			return nil, h.Errf("%s not a valid transport option", h.Val())
+		}
+	}
+
+	return &c, nil
+}
+
+func parseParallelGet(h *caddyfile.Dispenser) (*ParallelGetConfig, error) {
+	var c ParallelGetConfig
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "threshold", "part_size":
+			option := h.Val()
+			var size string
+			if !h.AllArgs(&size) {
+				return nil, h.ArgErr()
+			}
+			bytes, err := humanize.ParseBytes(size)
+			if err != nil || bytes == 0 {
+				return nil, h.Errf("'%s' is not a valid size", size)
+			}
+			if option == "threshold" {
+				c.Threshold = int64(bytes)
+			} else {
+				c.PartSize = int64(bytes)
+			}
+		case "concurrency":
+			var count string
+			if !h.AllArgs(&count) {
+				return nil, h.ArgErr()
+			}
+			n, err := strconv.Atoi(count)
+			if err != nil || n < 1 {
+				return nil, h.Errf("concurrency '%s' is not a valid count", count)
+			}
+			c.Concurrency = n
+		default:
+			return nil, h.Errf("%s not a valid parallel_get option", h.Val())
+		}
+	}
+
+	return &c, nil
+}
+
+func parseReplica(h *caddyfile.Dispenser) (*ReplicaConfig, error) {
+	var c ReplicaConfig
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "bucket":
+			if !h.AllArgs(&c.Bucket) {
+				return nil, h.ArgErr()
+			}
+		case "region":
+			if !h.AllArgs(&c.Region) {
+				return nil, h.ArgErr()
+			}
+		case "endpoint":
+			if !h.AllArgs(&c.Endpoint) {
+				return nil, h.ArgErr()
+			}
+		case "timeout":
+			var timeout string
+			if !h.AllArgs(&timeout) {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(timeout)
+			if err != nil {
+				return nil, h.Errf("'%s' is not a valid duration", timeout)
+			}
+			c.Timeout = caddy.Duration(dur)
+		default:
+			return nil, h.Errf("%s not a valid replica option", h.Val())
+		}
+	}
+
+	if c.Bucket == "" {
+		return nil, h.Err("replica bucket must be set")
+	}
+
+	return &c, nil
+}
+
+func parseCircuitBreaker(h *caddyfile.Dispenser) (*CircuitBreakerConfig, error) {
+	var c CircuitBreakerConfig
+
+	parseDuration := func() (caddy.Duration, error) {
+		var value string
+		if !h.AllArgs(&value) {
+			return 0, h.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(value)
+		if err != nil {
+			return 0, h.Errf("'%s' is not a valid duration", value)
+		}
+		return caddy.Duration(dur), nil
+	}
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		var err error
+		switch h.Val() {
+		case "error_ratio":
+			var ratio string
+			if !h.AllArgs(&ratio) {
+				return nil, h.ArgErr()
+			}
+			c.ErrorRatio, err = strconv.ParseFloat(ratio, 64)
+			if err != nil || c.ErrorRatio <= 0 || c.ErrorRatio > 1 {
+				return nil, h.Errf("'%s' is not a valid error ratio", ratio)
+			}
+		case "latency":
+			c.Latency, err = parseDuration()
+		case "window":
+			c.Window, err = parseDuration()
+		case "cooldown":
+			c.Cooldown, err = parseDuration()
+		case "min_requests":
+			var minRequests string
+			if !h.AllArgs(&minRequests) {
+				return nil, h.ArgErr()
+			}
+			c.MinRequests, err = strconv.Atoi(minRequests)
+			if err != nil || c.MinRequests < 1 {
+				return nil, h.Errf("'%s' is not a valid request count", minRequests)
+			}
+		case "stale":
+			args := h.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return nil, h.ArgErr()
+			}
+			var sizes []int64
+			for _, arg := range args {
+				size, err := humanize.ParseBytes(arg)
+				if err != nil {
+					return nil, h.Errf("'%s' is not a valid size", arg)
+				}
+				sizes = append(sizes, int64(size))
+			}
+			c.StaleCacheSize = sizes[0]
+			if len(sizes) == 2 {
+				c.StaleMaxObjectSize = sizes[1]
+			}
+		default:
+			return nil, h.Errf("%s not a valid circuit_breaker option", h.Val())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &c, nil
+}
+
+func parseSignedURLs(h *caddyfile.Dispenser) (*SignedURLConfig, error) {
+	var c SignedURLConfig
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "key":
+			var key SigningKey
+			if !h.AllArgs(&key.ID, &key.Secret) {
+				return nil, h.ArgErr()
+			}
+			c.Keys = append(c.Keys, key)
+		case "issue_path":
+			if !h.AllArgs(&c.IssuePath) {
+				return nil, h.ArgErr()
+			}
+		case "admin_token":
+			c.AdminTokens = append(c.AdminTokens, h.RemainingArgs()...)
+			if len(c.AdminTokens) == 0 {
+				return nil, h.ArgErr()
+			}
+		case "max_expiry":
+			var maxExpiry string
+			if !h.AllArgs(&maxExpiry) {
+				return nil, h.ArgErr()
+			}
+			dur, err := caddy.ParseDuration(maxExpiry)
+			if err != nil {
+				return nil, h.Errf("'%s' is not a valid duration", maxExpiry)
+			}
+			c.MaxExpiry = caddy.Duration(dur)
+		case "state_prefix":
+			if !h.AllArgs(&c.StatePrefix) {
+				return nil, h.ArgErr()
+			}
+		default:
+			return nil, h.Errf("%s not a valid signed_urls option", h.Val())
+		}
+	}
+
+	if len(c.Keys) == 0 {
+		return nil, h.Err("signed_urls needs at least one key")
+	}
+
+	return &c, nil
+}
+
+func parseHostPrefixes(h *caddyfile.Dispenser) (*HostPrefixConfig, error) {
+	var c HostPrefixConfig
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		switch h.Val() {
+		case "map":
+			var mapping HostMapping
+			if !h.AllArgs(&mapping.Pattern, &mapping.Prefix) {
+				return nil, h.ArgErr()
+			}
+			c.Mappings = append(c.Mappings, mapping)
+		case "fallback":
+			if !h.AllArgs(&c.Fallback) {
+				return nil, h.ArgErr()
+			}
+		case "reject":
+			c.Reject = append(c.Reject, h.RemainingArgs()...)
+			if len(c.Reject) == 0 {
+				return nil, h.ArgErr()
+			}
+		default:
+			return nil, h.Errf("%s not a valid hosts option", h.Val())
+		}
+	}
+
+	if len(c.Mappings) == 0 && c.Fallback == "" {
+		return nil, h.Err("hosts needs a map or a fallback")
+	}
+
+	return &c, nil
+}
@@ -3,7 +3,9 @@ package caddys3proxy
 import (
 	"reflect"
 	"testing"
+	"time"
 
+	caddy "github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 )
 
@@ -105,6 +107,18 @@ func TestParseCaddyfile(t *testing.T) {
 				Region:   "myregion",
 			},
 		},
+		testCase{
+			desc: "placeholders in bucket and region",
+			input: `s3proxy {
+				bucket site-{http.request.host}
+				region {http.vars.region}
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket: "site-{http.request.host}",
+				Region: "{http.vars.region}",
+			},
+		},
 		testCase{
 			desc: "enable pu",
 			input: `s3proxy {
@@ -129,6 +143,542 @@ func TestParseCaddyfile(t *testing.T) {
 				EnableDelete: true,
 			},
 		},
+		testCase{
+			desc: "enable form upload",
+			input: `s3proxy {
+				bucket mybucket
+				enable_form_upload
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket:           "mybucket",
+				EnableFormUpload: true,
+			},
+		},
+		testCase{
+			desc: "enable tus with state prefix",
+			input: `s3proxy {
+				bucket mybucket
+				tus /uploads/.state/
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket:         "mybucket",
+				EnableTus:      true,
+				TusStatePrefix: "/uploads/.state/",
+			},
+		},
+		testCase{
+			desc: "tus bad # args",
+			input: `s3proxy {
+				bucket mybucket
+				tus one two
+			}`,
+			shouldErr: true,
+			errString: "Testfile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'two'",
+		},
+		testCase{
+			desc: "presign block",
+			input: `s3proxy {
+				bucket mybucket
+				presign /presign {
+					token one two
+					allow /uploads/
+					expiry 5m
+					content_types image/*
+					max_size 10MB
+				}
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket: "mybucket",
+				Presign: &PresignConfig{
+					Path:          "/presign",
+					Tokens:        []string{"one", "two"},
+					AllowPrefixes: []string{"/uploads/"},
+					Expiry:        caddy.Duration(5 * time.Minute),
+					ContentTypes:  []string{"image/*"},
+					MaxSize:       10000000,
+				},
+			},
+		},
+		testCase{
+			desc: "presign bad option",
+			input: `s3proxy {
+				bucket mybucket
+				presign /presign {
+					foo
+				}
+			}`,
+			shouldErr: true,
+			errString: "Testfile:4 - Error during parsing: foo not a valid presign option",
+		},
+		testCase{
+			desc: "signed urls block",
+			input: `s3proxy {
+				bucket mybucket
+				signed_urls {
+					key new s3cr3t
+					key old 0ld
+					issue_path /admin/share
+					admin_token admin
+					max_expiry 48h
+				}
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket: "mybucket",
+				SignedURLs: &SignedURLConfig{
+					Keys: []SigningKey{
+						{ID: "new", Secret: "s3cr3t"},
+						{ID: "old", Secret: "0ld"},
+					},
+					IssuePath:   "/admin/share",
+					AdminTokens: []string{"admin"},
+					MaxExpiry:   caddy.Duration(48 * time.Hour),
+				},
+			},
+		},
+		testCase{
+			desc: "signed urls without key",
+			input: `s3proxy {
+				bucket mybucket
+				signed_urls {
+					issue_path /admin/share
+				}
+			}`,
+			shouldErr: true,
+			errString: "Testfile:5 - Error during parsing: signed_urls needs at least one key",
+		},
+		testCase{
+			desc: "hosts block",
+			input: `s3proxy {
+				bucket previews
+				hosts {
+					map *.preview.example.com /{labels.3}/
+					fallback /main/
+					reject admin.preview.example.com
+				}
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket: "previews",
+				HostPrefixes: &HostPrefixConfig{
+					Mappings: []HostMapping{
+						{Pattern: "*.preview.example.com", Prefix: "/{labels.3}/"},
+					},
+					Fallback: "/main/",
+					Reject:   []string{"admin.preview.example.com"},
+				},
+			},
+		},
+		testCase{
+			desc: "hosts block map bad # args",
+			input: `s3proxy {
+				bucket previews
+				hosts {
+					map *.preview.example.com
+				}
+			}`,
+			shouldErr: true,
+			errString: "Testfile:4 - Error during parsing: Wrong argument count or unexpected line ending after '*.preview.example.com'",
+		},
+		testCase{
+			desc: "release pointer",
+			input: `s3proxy {
+				bucket mybucket
+				release_pointer /current 30s
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket:            "mybucket",
+				ReleasePointer:    "/current",
+				ReleasePointerTTL: caddy.Duration(30 * time.Second),
+			},
+		},
+		testCase{
+			desc: "release pointer bad ttl",
+			input: `s3proxy {
+				bucket mybucket
+				release_pointer /current soon
+			}`,
+			shouldErr: true,
+			errString: "Testfile:3 - Error during parsing: 'soon' is not a valid duration",
+		},
+		testCase{
+			desc: "deploy with concurrency",
+			input: `s3proxy {
+				bucket mybucket
+				deploy 4
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket:            "mybucket",
+				EnableDeploy:      true,
+				DeployConcurrency: 4,
+			},
+		},
+		testCase{
+			desc: "deploy with limits",
+			input: `s3proxy {
+				bucket mybucket
+				deploy 4 100MiB 1GiB
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket:            "mybucket",
+				EnableDeploy:      true,
+				DeployConcurrency: 4,
+				DeployMaxSize:     100 << 20,
+				DeployMaxExtract:  1 << 30,
+			},
+		},
+		testCase{
+			desc: "enable sync",
+			input: `s3proxy {
+				bucket mybucket
+				deploy
+				sync
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket:       "mybucket",
+				EnableDeploy: true,
+				EnableSync:   true,
+			},
+		},
+		testCase{
+			desc: "content addressed with key template",
+			input: `s3proxy {
+				bucket mybucket
+				content_addressed blobs/${sha256}
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket:                 "mybucket",
+				EnableContentAddressed: true,
+				ContentAddressedKey:    "blobs/${sha256}",
+			},
+		},
+		testCase{
+			desc: "overlays in order",
+			input: `s3proxy {
+				bucket patches
+				overlay base
+				overlay archive old/
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket: "patches",
+				Overlays: []OverlaySource{
+					{Bucket: "base"},
+					{Bucket: "archive", Prefix: "old/"},
+				},
+			},
+		},
+		testCase{
+			desc: "credentials",
+			input: `s3proxy {
+				bucket mybucket
+				credentials {
+					access_key {env.S3_KEY_ID} {file./run/secrets/s3_secret}
+					role_arn arn:aws:iam::123456789012:role/reader
+					external_id abc
+					session_name caddy
+					duration 1h
+				}
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket: "mybucket",
+				Credentials: &CredentialsConfig{
+					AccessKeyID:     "{env.S3_KEY_ID}",
+					SecretAccessKey: "{file./run/secrets/s3_secret}",
+					RoleARN:         "arn:aws:iam::123456789012:role/reader",
+					ExternalID:      "abc",
+					SessionName:     "caddy",
+					Duration:        caddy.Duration(time.Hour),
+				},
+			},
+		},
+		testCase{
+			desc: "anonymous credentials",
+			input: `s3proxy {
+				bucket mybucket
+				credentials {
+					anonymous
+				}
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket:      "mybucket",
+				Credentials: &CredentialsConfig{Anonymous: true},
+			},
+		},
+		testCase{
+			desc: "credentials access key without secret",
+			input: `s3proxy {
+				bucket mybucket
+				credentials {
+					access_key AKIAEXAMPLE
+				}
+			}`,
+			shouldErr: true,
+			errString: "Testfile:4 - Error during parsing: Wrong argument count or unexpected line ending after 'AKIAEXAMPLE'",
+		},
+		testCase{
+			desc: "endpoints",
+			input: `s3proxy {
+				bucket mybucket
+				endpoint http://minio1:9000 http://minio2:9000 {
+					policy least_latency
+					max_fails 3
+					cooldown 1m
+				}
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket:           "mybucket",
+				Endpoints:        []string{"http://minio1:9000", "http://minio2:9000"},
+				EndpointPolicy:   "least_latency",
+				EndpointMaxFails: 3,
+				EndpointCooldown: caddy.Duration(time.Minute),
+			},
+		},
+		testCase{
+			desc: "parallel get",
+			input: `s3proxy {
+				bucket mybucket
+				parallel_get {
+					threshold 128MiB
+					part_size 16MiB
+					concurrency 8
+				}
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket: "mybucket",
+				ParallelGet: &ParallelGetConfig{
+					Threshold:   128 << 20,
+					PartSize:    16 << 20,
+					Concurrency: 8,
+				},
+			},
+		},
+		testCase{
+			desc: "chunk cache",
+			input: `s3proxy {
+				bucket mybucket
+				chunk_cache 512MiB 2MiB
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket: "mybucket",
+				ChunkCache: &ChunkCacheConfig{
+					Size:      512 << 20,
+					ChunkSize: 2 << 20,
+				},
+			},
+		},
+		testCase{
+			desc: "not found cache",
+			input: `s3proxy {
+				bucket mybucket
+				not_found_cache 5s 500
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket: "mybucket",
+				NotFoundCache: &NotFoundCacheConfig{
+					TTL:        caddy.Duration(5 * time.Second),
+					MaxEntries: 500,
+				},
+			},
+		},
+		testCase{
+			desc: "not found cache bad max entries",
+			input: `s3proxy {
+				bucket mybucket
+				not_found_cache 5s lots
+			}`,
+			shouldErr: true,
+			errString: "Testfile:3 - Error during parsing: 'lots' is not a valid number of entries",
+		},
+		testCase{
+			desc: "hedge",
+			input: `s3proxy {
+				bucket mybucket
+				hedge 80ms 0.05
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket: "mybucket",
+				Hedge: &HedgeConfig{
+					Delay:  caddy.Duration(80 * time.Millisecond),
+					Budget: 0.05,
+				},
+			},
+		},
+		testCase{
+			desc: "transport",
+			input: `s3proxy {
+				bucket mybucket
+				transport {
+					max_idle_conns_per_host 64
+					idle_timeout 2m
+					tls_ca /etc/ssl/minio-ca.pem
+					tls_min_version 1.3
+					proxy http://proxy.local:3128
+					versions 1.1
+					dual_stack
+				}
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket: "mybucket",
+				Transport: &TransportConfig{
+					MaxIdleConnsPerHost: 64,
+					IdleTimeout:         caddy.Duration(2 * time.Minute),
+					TLSCAFiles:          []string{"/etc/ssl/minio-ca.pem"},
+					TLSMinVersion:       "1.3",
+					Proxy:               "http://proxy.local:3128",
+					Versions:            []string{"1.1"},
+					DualStack:           true,
+				},
+			},
+		},
+		testCase{
+			desc: "transport bad http version",
+			input: `s3proxy {
+				bucket mybucket
+				transport {
+					versions 3
+				}
+			}`,
+			shouldErr: true,
+			errString: "Testfile:4 - Error during parsing: '3' is not a valid HTTP version",
+		},
+		testCase{
+			desc: "replica",
+			input: `s3proxy {
+				bucket mybucket
+				replica {
+					bucket mybucket-replica
+					region us-east-1
+					timeout 2s
+				}
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket: "mybucket",
+				Replica: &ReplicaConfig{
+					Bucket:  "mybucket-replica",
+					Region:  "us-east-1",
+					Timeout: caddy.Duration(2 * time.Second),
+				},
+			},
+		},
+		testCase{
+			desc: "replica without bucket",
+			input: `s3proxy {
+				bucket mybucket
+				replica {
+					region us-east-1
+				}
+			}`,
+			shouldErr: true,
+			errString: "Testfile:5 - Error during parsing: replica bucket must be set",
+		},
+		testCase{
+			desc: "circuit breaker and health",
+			input: `s3proxy {
+				bucket mybucket
+				circuit_breaker {
+					error_ratio 0.25
+					latency 5s
+					min_requests 10
+					cooldown 1m
+					stale 64MiB 512KiB
+				}
+				health /healthz
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket: "mybucket",
+				CircuitBreaker: &CircuitBreakerConfig{
+					ErrorRatio:         0.25,
+					Latency:            caddy.Duration(5 * time.Second),
+					MinRequests:        10,
+					Cooldown:           caddy.Duration(time.Minute),
+					StaleCacheSize:     64 << 20,
+					StaleMaxObjectSize: 512 << 10,
+				},
+				HealthPath: "/healthz",
+			},
+		},
+		testCase{
+			desc: "circuit breaker bad error ratio",
+			input: `s3proxy {
+				bucket mybucket
+				circuit_breaker {
+					error_ratio 2
+				}
+			}`,
+			shouldErr: true,
+			errString: "Testfile:4 - Error during parsing: '2' is not a valid error ratio",
+		},
+		testCase{
+			desc: "health with canary",
+			input: `s3proxy {
+				bucket mybucket
+				health /health-check {
+					canary /canary.txt
+					interval 30s
+				}
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket:         "mybucket",
+				HealthPath:     "/health-check",
+				HealthCanary:   "/canary.txt",
+				HealthInterval: caddy.Duration(30 * time.Second),
+			},
+		},
+		testCase{
+			desc: "startup probe with list",
+			input: `s3proxy {
+				bucket mybucket
+				startup_probe list
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket:           "mybucket",
+				StartupProbe:     true,
+				StartupProbeList: true,
+			},
+		},
+		testCase{
+			desc: "origin",
+			input: `s3proxy {
+				bucket mybucket
+				origin http://localhost:8080 30s
+			}`,
+			shouldErr: false,
+			obj: S3Proxy{
+				Bucket:        "mybucket",
+				Origin:        "http://localhost:8080",
+				OriginTimeout: caddy.Duration(30 * time.Second),
+			},
+		},
+		testCase{
+			desc: "deploy bad concurrency",
+			input: `s3proxy {
+				bucket mybucket
+				deploy lots
+			}`,
+			shouldErr: true,
+			errString: "Testfile:3 - Error during parsing: 'lots' is not a valid deploy concurrency",
+		},
 		testCase{
 			desc: "enable error pages",
 			input: `s3proxy {
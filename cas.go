@@ -0,0 +1,147 @@
+package caddys3proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const defaultContentAddressedKey = "cas/sha256/${sha256:2}/${sha256}"
+
+// Matches ${sha256} and ${sha256:N} (the first N hex digits)
+var sha256Placeholder = regexp.MustCompile(`\$\{sha256(?::(\d+))?\}`)
+
+// ContentAddressedUpload is the response of a content-addressed PUT.
+type ContentAddressedUpload struct {
+	Key     string `json:"key"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+	Created bool   `json:"created"`
+}
+
+// contentAddressedKey expands a key template with the hex SHA-256 of a body.
+func contentAddressedKey(template string, sum string) (string, error) {
+	if template == "" {
+		template = defaultContentAddressedKey
+	}
+	if !sha256Placeholder.MatchString(template) {
+		return "", errors.New("key template must contain ${sha256}")
+	}
+
+	rel := sha256Placeholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		n := sha256Placeholder.FindStringSubmatch(placeholder)[1]
+		if n == "" {
+			return sum
+		}
+		digits, _ := strconv.Atoi(n)
+		if digits > len(sum) {
+			digits = len(sum)
+		}
+		return sum[:digits]
+	})
+	if strings.HasSuffix(rel, "/") {
+		return "", errors.New("key must name an object")
+	}
+	for _, segment := range strings.Split(rel, "/") {
+		if segment == ".." {
+			return "", errors.New("key must not contain '..'")
+		}
+	}
+	return rel, nil
+}
+
+// ContentAddressedPutHandler stores the body of a PUT to a "directory" under a key made from its
+// SHA-256. If that key already exists nothing is written. Either way Location points to the object.
+func (p S3Proxy) ContentAddressedPutHandler(w http.ResponseWriter, r *http.Request, dirKey string) error {
+	// The key is only known once the whole body has been read, so spool it to a temp file
+	// while hashing instead of holding it in memory
+	tmp, err := ioutil.TempFile("", "s3proxy-cas-*")
+	if err != nil {
+		return convertToCaddyError(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r.Body)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	rel, err := contentAddressedKey(p.ContentAddressedKey, sum)
+	if err != nil {
+		return convertToCaddyError(err)
+	}
+	key := path.Join(dirKey, rel)
+	if fileHidden(key, p.Hide) {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("key is hidden"))
+	}
+
+	created := false
+	_, err = p.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(p.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if convertToCaddyError(err).StatusCode != http.StatusNotFound {
+			return convertToCaddyError(err)
+		}
+
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return convertToCaddyError(err)
+		}
+		oi := s3.PutObjectInput{
+			Bucket:             aws.String(p.Bucket),
+			Key:                aws.String(key),
+			CacheControl:       makeAwsString(r.Header.Get("Cache-Control")),
+			ContentDisposition: makeAwsString(r.Header.Get("Content-Disposition")),
+			ContentEncoding:    makeAwsString(r.Header.Get("Content-Encoding")),
+			ContentLanguage:    makeAwsString(r.Header.Get("Content-Language")),
+			ContentType:        makeAwsString(r.Header.Get("Content-Type")),
+			Metadata:           map[string]*string{sha256MetadataKey: aws.String(sum)},
+			Body:               tmp,
+		}
+		po, err := p.client.PutObject(&oi)
+		if err != nil {
+			return convertToCaddyError(err)
+		}
+		p.forgetNotFound(key)
+		setStrHeader(w, "ETag", po.ETag)
+		created = true
+	}
+
+	p.log.Debug("content-addressed put",
+		zap.String("bucket", p.Bucket),
+		zap.String("key", key),
+		zap.Int64("size", size),
+		zap.Bool("created", created),
+	)
+
+	// The Location must be what the client asked for, not a rewritten URI
+	w.Header().Set("Location", path.Join(originalURL(r).Path, rel))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return json.NewEncoder(w).Encode(ContentAddressedUpload{
+		Key:     strings.TrimPrefix(key, "/"),
+		SHA256:  sum,
+		Size:    size,
+		Created: created,
+	})
+}
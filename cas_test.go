@@ -0,0 +1,118 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestContentAddressedKey(t *testing.T) {
+	sum := sha256Hex([]byte("hello"))
+
+	type testCase struct {
+		name      string
+		template  string
+		expected  string
+		shouldErr bool
+	}
+
+	testCases := []testCase{
+		{name: "default template", template: "", expected: "cas/sha256/2c/" + sum},
+		{name: "short prefix", template: "${sha256:4}/${sha256}.bin", expected: "2cf2/" + sum + ".bin"},
+		{name: "prefix longer than hash", template: "${sha256:100}", expected: sum},
+		{name: "no hash", template: "blobs/latest", shouldErr: true},
+		{name: "dir key", template: "${sha256}/", shouldErr: true},
+		{name: "dot dot", template: "../${sha256}", shouldErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := contentAddressedKey(tc.template, sum)
+			if tc.shouldErr {
+				if err == nil {
+					t.Errorf("Expected an error, got key %s", key)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != tc.expected {
+				t.Errorf("Expected key %s, got %s", tc.expected, key)
+			}
+		})
+	}
+}
+
+func TestContentAddressedPut(t *testing.T) {
+	client := newS3Client(t)
+	bucketName := setupTestBucket(t, client)
+
+	proxy := S3Proxy{
+		Bucket:                 bucketName,
+		EnablePut:              true,
+		EnableContentAddressed: true,
+		client:                 client,
+		log:                    zap.NewExample(),
+	}
+
+	sum := sha256Hex([]byte("build output"))
+	location := "/cache/cas/sha256/" + sum[:2] + "/" + sum
+
+	for _, expectedCode := range []int{http.StatusCreated, http.StatusOK} {
+		req := httptest.NewRequest(http.MethodPut, "/cache/", bytes.NewReader([]byte("build output")))
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		resp := httptest.NewRecorder()
+		_ = proxy.ServeHTTP(resp, req, nil)
+
+		if resp.Code != expectedCode {
+			t.Fatalf("Expected code %d, got %d", expectedCode, resp.Code)
+		}
+		if got := resp.Header().Get("Location"); got != location {
+			t.Errorf("Expected location %s, got %s", location, got)
+		}
+		var upload ContentAddressedUpload
+		if err := json.NewDecoder(resp.Body).Decode(&upload); err != nil {
+			t.Fatal(err)
+		}
+		if upload.SHA256 != sum || upload.Created != (expectedCode == http.StatusCreated) {
+			t.Errorf("Unexpected response %+v", upload)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, location, nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	resp := httptest.NewRecorder()
+	_ = proxy.ServeHTTP(resp, req, nil)
+	if resp.Code != http.StatusOK || resp.Body.String() != "build output" {
+		t.Errorf("Expected the stored object, got %d %q", resp.Code, resp.Body.String())
+	}
+
+	// The Location is under the path the client asked for, not the rewritten one
+	req = httptest.NewRequest(http.MethodPut, "/public/", bytes.NewReader([]byte("build output")))
+	ctx := context.WithValue(req.Context(), caddyhttp.OriginalRequestCtxKey, *req.Clone(req.Context()))
+	req = req.WithContext(context.WithValue(ctx, caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	req.URL.Path = "/cache/"
+	resp = httptest.NewRecorder()
+	_ = proxy.ServeHTTP(resp, req, nil)
+	if got := resp.Header().Get("Location"); got != "/public/cas/sha256/"+sum[:2]+"/"+sum {
+		t.Errorf("Expected the location under the original path, got %s", got)
+	}
+
+	// Without enable_put nothing can be written
+	proxy.EnablePut = false
+	req = httptest.NewRequest(http.MethodPut, "/cache/", bytes.NewReader([]byte("other output")))
+	req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+	resp = httptest.NewRecorder()
+	_ = proxy.ServeHTTP(resp, req, nil)
+	if resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected a 405 without enable_put, got %d", resp.Code)
+	}
+}
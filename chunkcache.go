@@ -0,0 +1,383 @@
+package caddys3proxy
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const defaultChunkSize = 1 << 20
+
+// How long the ETag and size of an object are kept, Range requests in that time don't ask S3 for them
+const chunkHeadTTL = 10 * time.Second
+
+// Bytes a kept head counts for in the cache size
+const chunkHeadSize = 512
+
+// ChunkCacheConfig keeps fixed-size chunks of objects in memory to serve Range requests from.
+type ChunkCacheConfig struct {
+	// Bytes of chunks kept, least recently used ones are dropped first
+	Size int64 `json:"size,omitempty"`
+
+	// Size of a chunk. Default is 1MiB.
+	ChunkSize int64 `json:"chunk_size,omitempty"`
+}
+
+// chunkCache holds chunks keyed by bucket, key, ETag and chunk number. It is separate from
+// (and has its own limit from) the stale cache, which keeps whole objects.
+type chunkCache struct {
+	maxSize   int64
+	chunkSize int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// chunkEntry is a chunk, or the head of an object the chunks belong to
+type chunkEntry struct {
+	key     string
+	data    []byte
+	head    *s3.HeadObjectOutput
+	expires time.Time
+}
+
+func (e *chunkEntry) size() int64 {
+	if e.head != nil {
+		return chunkHeadSize
+	}
+	return int64(len(e.data))
+}
+
+func newChunkCache(config ChunkCacheConfig) *chunkCache {
+	c := &chunkCache{
+		maxSize:   config.Size,
+		chunkSize: config.ChunkSize,
+		order:     list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+	if c.chunkSize <= 0 {
+		c.chunkSize = defaultChunkSize
+	}
+	return c
+}
+
+func chunkKey(bucket string, key string, etag string, index int64) string {
+	return bucket + "|" + key + "|" + etag + "|" + strconv.FormatInt(index, 10)
+}
+
+func chunkHeadKey(oi *s3.GetObjectInput) string {
+	return aws.StringValue(oi.Bucket) + "|" + aws.StringValue(oi.Key) + "|" + aws.StringValue(oi.VersionId) + "|head"
+}
+
+func (c *chunkCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*chunkEntry).data, true
+}
+
+func (c *chunkCache) put(key string, data []byte) {
+	c.add(&chunkEntry{key: key, data: data})
+}
+
+// getHead returns the head of an object if it was kept less than the TTL ago
+func (c *chunkCache) getHead(key string) (*s3.HeadObjectOutput, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*chunkEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.head, true
+}
+
+func (c *chunkCache) putHead(key string, head *s3.HeadObjectOutput) {
+	c.add(&chunkEntry{key: key, head: head, expires: time.Now().Add(chunkHeadTTL)})
+}
+
+func (c *chunkCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+func (c *chunkCache) add(entry *chunkEntry) {
+	if entry.size() > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.entries[entry.key]; ok {
+		c.remove(old)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.size += entry.size()
+	for c.size > c.maxSize {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops elem, c.mu must be held
+func (c *chunkCache) remove(elem *list.Element) {
+	entry := elem.Value.(*chunkEntry)
+	c.order.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+// chunkedGetObject answers a Range request from cached chunks, fetching the missing ones.
+// The ETag and size of the current version come from a HeadObject, kept for a few seconds.
+// Requests with conditional headers always send it, so S3 checks them.
+func (p S3Proxy) chunkedGetObject(ctx aws.Context, oi *s3.GetObjectInput, start int64, end int64) (*s3.GetObjectOutput, error) {
+	head, cached, err := p.chunkHead(ctx, oi)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := p.chunkedResponse(ctx, oi, head, start, end)
+	if cached && err != nil && convertToCaddyError(err).StatusCode == http.StatusPreconditionFailed {
+		// The object changed since its head was kept
+		p.chunks.forget(chunkHeadKey(oi))
+		if head, _, err = p.chunkHead(ctx, oi); err != nil {
+			return nil, err
+		}
+		obj, err = p.chunkedResponse(ctx, oi, head, start, end)
+	}
+	return obj, err
+}
+
+// chunkHead returns the head of the object, and whether it came from the cache
+func (p S3Proxy) chunkHead(ctx aws.Context, oi *s3.GetObjectInput) (*s3.HeadObjectOutput, bool, error) {
+	conditional := oi.IfMatch != nil || oi.IfNoneMatch != nil || oi.IfModifiedSince != nil || oi.IfUnmodifiedSince != nil
+	if !conditional {
+		if head, ok := p.chunks.getHead(chunkHeadKey(oi)); ok {
+			return head, true, nil
+		}
+	}
+
+	head, err := p.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:            oi.Bucket,
+		Key:               oi.Key,
+		VersionId:         oi.VersionId,
+		IfMatch:           oi.IfMatch,
+		IfNoneMatch:       oi.IfNoneMatch,
+		IfModifiedSince:   oi.IfModifiedSince,
+		IfUnmodifiedSince: oi.IfUnmodifiedSince,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if aws.StringValue(head.ETag) != "" {
+		p.chunks.putHead(chunkHeadKey(oi), head)
+	}
+	return head, false, nil
+}
+
+// chunkedResponse answers the range of the object described by head. If the first chunk is not
+// cached its fetch is started at once, so an object that changed fails before anything is sent.
+func (p S3Proxy) chunkedResponse(ctx aws.Context, oi *s3.GetObjectInput, head *s3.HeadObjectOutput, start int64, end int64) (*s3.GetObjectOutput, error) {
+	// Without an ETag the chunks of two versions could get mixed
+	if aws.StringValue(head.ETag) == "" {
+		return p.sendGetObject(ctx, oi)
+	}
+
+	size := aws.Int64Value(head.ContentLength)
+	if start >= size {
+		return nil, caddyhttp.Error(http.StatusRequestedRangeNotSatisfiable,
+			fmt.Errorf("range starts at %d but the object has %d bytes", start, size))
+	}
+	last := size - 1
+	if end >= 0 && end < last {
+		last = end
+	}
+
+	body := &chunkBody{
+		p:      p,
+		ctx:    ctx,
+		input:  oi,
+		etag:   aws.StringValue(head.ETag),
+		size:   size,
+		offset: start,
+		last:   last,
+	}
+	first := start / p.chunks.chunkSize
+	if _, ok := p.chunks.get(chunkKey(aws.StringValue(oi.Bucket), aws.StringValue(oi.Key), body.etag, first)); !ok {
+		if err := body.startFetch(first); err != nil {
+			return nil, err
+		}
+	}
+	return &s3.GetObjectOutput{
+		Body:               body,
+		CacheControl:       head.CacheControl,
+		ContentDisposition: head.ContentDisposition,
+		ContentEncoding:    head.ContentEncoding,
+		ContentLanguage:    head.ContentLanguage,
+		ContentLength:      aws.Int64(last - start + 1),
+		ContentRange:       aws.String(fmt.Sprintf("bytes %d-%d/%d", start, last, size)),
+		ContentType:        head.ContentType,
+		ETag:               head.ETag,
+		Expires:            head.Expires,
+		LastModified:       head.LastModified,
+		Metadata:           head.Metadata,
+	}, nil
+}
+
+// chunkBody reads the range from offset to last, chunk by chunk. A run of missing chunks is fetched
+// with one request, and its chunks are kept as they are read.
+type chunkBody struct {
+	p     S3Proxy
+	ctx   aws.Context
+	input *s3.GetObjectInput
+	etag  string
+	size  int64
+
+	// Next byte to read and last byte of the range
+	offset int64
+	last   int64
+
+	// The part of a chunk not read yet
+	current []byte
+
+	// The fetch of a run of missing chunks, and the next chunk it will give
+	fetch      io.ReadCloser
+	fetchIndex int64
+	fetchLast  int64
+}
+
+func (b *chunkBody) Read(p []byte) (int, error) {
+	if len(b.current) == 0 {
+		if b.offset > b.last {
+			return 0, io.EOF
+		}
+		chunk, err := b.chunk(b.offset / b.p.chunks.chunkSize)
+		if err != nil {
+			return 0, err
+		}
+		from := b.offset % b.p.chunks.chunkSize
+		to := int64(len(chunk))
+		if lastInChunk := b.last - (b.offset - from) + 1; lastInChunk < to {
+			to = lastInChunk
+		}
+		if from >= to {
+			return 0, io.ErrUnexpectedEOF
+		}
+		b.current = chunk[from:to]
+	}
+
+	n := copy(p, b.current)
+	b.current = b.current[n:]
+	b.offset += int64(n)
+	return n, nil
+}
+
+// chunk returns chunk index, from the cache or from S3
+func (b *chunkBody) chunk(index int64) ([]byte, error) {
+	cache := b.p.chunks
+	bucket := aws.StringValue(b.input.Bucket)
+	key := aws.StringValue(b.input.Key)
+
+	if b.fetch == nil || index != b.fetchIndex {
+		if data, ok := cache.get(chunkKey(bucket, key, b.etag, index)); ok {
+			return data, nil
+		}
+		if err := b.startFetch(index); err != nil {
+			return nil, err
+		}
+	}
+
+	length := cache.chunkSize
+	if rest := b.size - index*cache.chunkSize; rest < length {
+		length = rest
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(b.fetch, data); err != nil {
+		return nil, err
+	}
+	cache.put(chunkKey(bucket, key, b.etag, index), data)
+
+	b.fetchIndex++
+	if b.fetchIndex > b.fetchLast {
+		b.fetch.Close()
+		b.fetch = nil
+	}
+	return data, nil
+}
+
+// startFetch requests the run of missing chunks starting at index, up to the end of the range
+func (b *chunkBody) startFetch(index int64) error {
+	if b.fetch != nil {
+		b.fetch.Close()
+		b.fetch = nil
+	}
+
+	cache := b.p.chunks
+	bucket := aws.StringValue(b.input.Bucket)
+	key := aws.StringValue(b.input.Key)
+	lastIndex := b.last / cache.chunkSize
+	runLast := index
+	for runLast < lastIndex {
+		if _, ok := cache.get(chunkKey(bucket, key, b.etag, runLast+1)); ok {
+			break
+		}
+		runLast++
+	}
+
+	end := (runLast+1)*cache.chunkSize - 1
+	if end > b.size-1 {
+		end = b.size - 1
+	}
+	obj, err := b.p.sendGetObject(b.ctx, &s3.GetObjectInput{
+		Bucket:    b.input.Bucket,
+		Key:       b.input.Key,
+		VersionId: b.input.VersionId,
+		Range:     aws.String(fmt.Sprintf("bytes=%d-%d", index*cache.chunkSize, end)),
+		IfMatch:   aws.String(b.etag),
+	})
+	if err != nil {
+		return err
+	}
+	if obj.Body == nil {
+		return errors.New("no body in chunk fetch")
+	}
+	b.fetch = obj.Body
+	b.fetchIndex = index
+	b.fetchLast = runLast
+	return nil
+}
+
+func (b *chunkBody) Close() error {
+	if b.fetch != nil {
+		// The chunk being fetched is not kept
+		err := b.fetch.Close()
+		b.fetch = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+func TestChunkCacheEviction(t *testing.T) {
+	c := newChunkCache(ChunkCacheConfig{Size: 10, ChunkSize: 4})
+	c.put("a", []byte("aaaa"))
+	c.put("b", []byte("bbbb"))
+	c.get("a")
+	c.put("c", []byte("cccc"))
+
+	if _, ok := c.get("b"); ok {
+		t.Error("Expected the least recently used chunk to be dropped")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("Expected chunk %s to be kept", key)
+		}
+	}
+	c.put("big", make([]byte, 11))
+	if _, ok := c.get("big"); ok {
+		t.Error("Expected a chunk larger than the cache not to be kept")
+	}
+}
+
+func TestChunkedGetObject(t *testing.T) {
+	content := []byte("abcdefghijklmnopqrstuvwxyz")
+	etag := `"v1"`
+	var mu sync.Mutex
+	var heads int
+	var ranges []string
+	stub, client := newStubS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if r.Method == http.MethodHead {
+			heads++
+		} else {
+			ranges = append(ranges, r.Header.Get("Range"))
+		}
+		current, currentETag := content, etag
+		mu.Unlock()
+		w.Header().Set("ETag", currentETag)
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(current))
+	})
+	defer stub.Close()
+	proxy := S3Proxy{
+		client: client,
+		chunks: newChunkCache(ChunkCacheConfig{Size: 1 << 20, ChunkSize: 4}),
+		log:    zap.NewNop(),
+	}
+
+	get := func(rangeHeader string) (string, *s3.GetObjectOutput) {
+		obj, err := proxy.getS3Object(aws.BackgroundContext(), "mybucket", "video.mp4", http.Header{"Range": []string{rangeHeader}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(obj.Body)
+		obj.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body), obj
+	}
+
+	for _, tc := range []struct {
+		rangeHeader  string
+		expected     string
+		contentRange string
+		fetched      []string
+	}{
+		// Chunks 1 and 2
+		{rangeHeader: "bytes=5-10", expected: "fghijk", contentRange: "bytes 5-10/26", fetched: []string{"bytes=4-11"}},
+		// Chunk 0 is missing, 1 and 2 are kept, 3 is missing
+		{rangeHeader: "bytes=2-13", expected: "cdefghijklmn", contentRange: "bytes 2-13/26", fetched: []string{"bytes=0-3", "bytes=12-15"}},
+		// All kept
+		{rangeHeader: "bytes=4-15", expected: "efghijklmnop", contentRange: "bytes 4-15/26", fetched: nil},
+		// Open range up to the short last chunk
+		{rangeHeader: "bytes=20-", expected: "uvwxyz", contentRange: "bytes 20-25/26", fetched: []string{"bytes=20-25"}},
+	} {
+		mu.Lock()
+		ranges = nil
+		mu.Unlock()
+
+		body, obj := get(tc.rangeHeader)
+		if body != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.rangeHeader, tc.expected, body)
+		}
+		if aws.StringValue(obj.ContentRange) != tc.contentRange || aws.Int64Value(obj.ContentLength) != int64(len(tc.expected)) {
+			t.Errorf("%s: unexpected content range %q and length %d", tc.rangeHeader, aws.StringValue(obj.ContentRange), aws.Int64Value(obj.ContentLength))
+		}
+		if aws.StringValue(obj.ContentType) != "video/mp4" {
+			t.Errorf("%s: expected the content type of the object, got %q", tc.rangeHeader, aws.StringValue(obj.ContentType))
+		}
+		mu.Lock()
+		if len(ranges) != len(tc.fetched) {
+			t.Errorf("%s: expected fetches %v, got %v", tc.rangeHeader, tc.fetched, ranges)
+		} else {
+			for i := range ranges {
+				if ranges[i] != tc.fetched[i] {
+					t.Errorf("%s: expected fetches %v, got %v", tc.rangeHeader, tc.fetched, ranges)
+					break
+				}
+			}
+		}
+		mu.Unlock()
+	}
+
+	if heads != 1 {
+		t.Errorf("Expected the head to be kept between requests, got %d HeadObjects", heads)
+	}
+
+	// A chunk fetch that finds the object changed gets the new head
+	mu.Lock()
+	content = []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	etag = `"v2"`
+	mu.Unlock()
+	if body, _ := get("bytes=16-19"); body != "QRST" {
+		t.Errorf("Expected the new version, got %q", body)
+	}
+	if heads != 2 {
+		t.Errorf("Expected a new HeadObject once the object changed, got %d", heads)
+	}
+
+	if _, err := proxy.getS3Object(aws.BackgroundContext(), "mybucket", "video.mp4", http.Header{"Range": []string{"bytes=30-"}}); convertToCaddyError(err).StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected a 416 for a range past the end, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package caddys3proxy
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Most clients kept by a client cache, the least recently used ones are dropped first
+const maxCachedClients = 100
+
+// A resolved region goes into the host name of the requests, so it may only be a region name
+var regionPattern = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// clientCache holds one S3 client per region and endpoint, all sharing one session.
+// It is used when the region or endpoint are only known at request time.
+type clientCache struct {
+	sess *session.Session
+
+	mu      sync.Mutex
+	order   *list.List
+	clients map[string]*list.Element
+}
+
+type cachedClient struct {
+	key    string
+	client *s3.S3
+}
+
+func newClientCache(sess *session.Session) *clientCache {
+	return &clientCache{
+		sess:    sess,
+		order:   list.New(),
+		clients: make(map[string]*list.Element),
+	}
+}
+
+// get returns the client for region and endpoint, creating it if needed.
+// An empty region or endpoint means the session default.
+func (c *clientCache) get(region string, endpoint string) *s3.S3 {
+	cacheKey := region + "|" + endpoint
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.clients[cacheKey]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*cachedClient).client
+	}
+
+	var config aws.Config
+	if region != "" {
+		config.Region = aws.String(region)
+	}
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+	client := s3.New(c.sess, &config)
+	c.clients[cacheKey] = c.order.PushFront(&cachedClient{key: cacheKey, client: client})
+	for c.order.Len() > maxCachedClients {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.clients, oldest.Value.(*cachedClient).key)
+	}
+	return client
+}
+
+// hasPlaceholder returns true if s has a Caddy placeholder in it
+func hasPlaceholder(s string) bool {
+	return strings.Contains(s, "{") && strings.Contains(s, "}")
+}
+
+// hasRequestPlaceholder returns true if s has a placeholder that comes from the request
+func hasRequestPlaceholder(s string) bool {
+	return strings.Contains(s, "{http.")
+}
+
+// resolveForRequest replaces placeholders in the bucket, region and endpoint
+// and picks the S3 client to use for this request. It is a no-op unless one of them has placeholders.
+func (p *S3Proxy) resolveForRequest(repl *caddy.Replacer) error {
+	if p.clients == nil {
+		return nil
+	}
+
+	p.Bucket = repl.ReplaceAll(p.Bucket, "")
+	if p.Bucket == "" {
+		return caddyhttp.Error(http.StatusNotFound, errors.New("no bucket for request"))
+	}
+	// The bucket may come from the Host header or the path, which the client chooses
+	if hasPlaceholder(p.Bucket) || validBucketName(p.Bucket) != nil {
+		return caddyhttp.Error(http.StatusNotFound, errors.New("invalid bucket for request"))
+	}
+	p.Region = repl.ReplaceAll(p.Region, "")
+	if p.Region != "" && !regionPattern.MatchString(p.Region) {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("invalid region for request"))
+	}
+	p.Endpoint = repl.ReplaceAll(p.Endpoint, "")
+	p.client = p.clients.get(p.Region, p.Endpoint)
+	return nil
+}
@@ -0,0 +1,96 @@
+package caddys3proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestResolveForRequest(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := S3Proxy{
+		Bucket:  "site-{http.vars.tenant}",
+		Region:  "{http.vars.region}",
+		clients: newClientCache(sess),
+	}
+
+	repl := caddy.NewReplacer()
+	repl.Set("http.vars.tenant", "acme")
+	repl.Set("http.vars.region", "eu-west-1")
+
+	resolved := p
+	if err := resolved.resolveForRequest(repl); err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Bucket != "site-acme" {
+		t.Errorf("Expected bucket 'site-acme', got '%s'", resolved.Bucket)
+	}
+	if region := aws.StringValue(resolved.client.Config.Region); region != "eu-west-1" {
+		t.Errorf("Expected client for region 'eu-west-1', got '%s'", region)
+	}
+	if p.Bucket != "site-{http.vars.tenant}" {
+		t.Errorf("Resolving must not change the configured bucket, got '%s'", p.Bucket)
+	}
+
+	// Same region gets the same client
+	again := p
+	if err := again.resolveForRequest(repl); err != nil {
+		t.Fatal(err)
+	}
+	if again.client != resolved.client {
+		t.Errorf("Expected the client for a region to be cached")
+	}
+
+	// A region can't change the host requests go to
+	bad := caddy.NewReplacer()
+	bad.Set("http.vars.tenant", "acme")
+	bad.Set("http.vars.region", "x@evil.example/")
+	badRegion := p
+	if err := badRegion.resolveForRequest(bad); convertToCaddyError(err).StatusCode != 400 {
+		t.Errorf("Expected a 400 for a bad region, got %v", err)
+	}
+
+	// An unresolved bucket is a 404
+	empty := S3Proxy{Bucket: "{http.vars.nope}", clients: p.clients}
+	if err := empty.resolveForRequest(caddy.NewReplacer()); convertToCaddyError(err).StatusCode != 404 {
+		t.Errorf("Expected a 404 for an empty bucket, got %v", err)
+	}
+
+	// A bucket from the Host header must be a valid bucket name
+	for _, host := range []string{"Not_A_Bucket", "a..b", "{braces}", "192.168.0.1"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		byHost := S3Proxy{Bucket: "{http.request.host}", clients: p.clients}
+		if err := byHost.resolveForRequest(caddyhttp.NewTestReplacer(req)); convertToCaddyError(err).StatusCode != 404 {
+			t.Errorf("Expected a 404 for host '%s', got %v", host, err)
+		}
+	}
+}
+
+func TestClientCacheBound(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("us-east-1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClientCache(sess)
+	first := c.get("region-0", "")
+	for i := 1; i <= maxCachedClients; i++ {
+		c.get(fmt.Sprintf("region-%d", i), "")
+	}
+	if len(c.clients) != maxCachedClients || c.order.Len() != maxCachedClients {
+		t.Errorf("Expected at most %d clients, got %d", maxCachedClients, len(c.clients))
+	}
+	if c.get("region-0", "") == first {
+		t.Errorf("Expected the least recently used client to be dropped")
+	}
+}
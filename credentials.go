@@ -0,0 +1,183 @@
+package caddys3proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// Assumed role credentials are refreshed this long before they expire
+const credentialsExpiryWindow = time.Minute
+
+// CredentialsConfig sets where the credentials used to access S3 come from, instead of the SDK's default chain.
+type CredentialsConfig struct {
+	// Static keys. Values may be {env.*} or {file.*} placeholders.
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+
+	// Role to assume, with the static keys, the profile or the default chain
+	RoleARN     string         `json:"role_arn,omitempty"`
+	ExternalID  string         `json:"external_id,omitempty"`
+	SessionName string         `json:"session_name,omitempty"`
+	Duration    caddy.Duration `json:"duration,omitempty"`
+
+	// File holding an OIDC token to assume RoleARN with (like on EKS)
+	WebIdentityTokenFile string `json:"web_identity_token_file,omitempty"`
+
+	// Don't sign requests at all, for public buckets
+	Anonymous bool `json:"anonymous,omitempty"`
+}
+
+// resolveCredentialValue replaces {env.*} placeholders, and reads the file of a {file.*} placeholder.
+func resolveCredentialValue(value string) (string, error) {
+	if strings.HasPrefix(value, "{file.") && strings.HasSuffix(value, "}") {
+		filename := strings.TrimSuffix(strings.TrimPrefix(value, "{file."), "}")
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return caddy.NewReplacer().ReplaceKnown(value, ""), nil
+}
+
+// validate checks for options that can't be used together
+func (c CredentialsConfig) validate() error {
+	static := c.AccessKeyID != "" || c.SecretAccessKey != "" || c.SessionToken != ""
+	role := c.ExternalID != "" || c.SessionName != "" || c.Duration != 0 || c.WebIdentityTokenFile != ""
+	switch {
+	case c.Anonymous && (static || role || c.RoleARN != ""):
+		return errors.New("anonymous credentials can not be used with keys or roles")
+	case static && (c.AccessKeyID == "" || c.SecretAccessKey == ""):
+		return errors.New("access key needs both an access key id and a secret access key")
+	case role && c.RoleARN == "":
+		return errors.New("external_id, session_name, duration and web_identity_token_file need a role_arn")
+	case c.WebIdentityTokenFile != "" && static:
+		return errors.New("web_identity_token_file can not be used with an access key")
+	case c.WebIdentityTokenFile != "" && c.ExternalID != "":
+		return errors.New("web_identity_token_file can not be used with an external_id")
+	case c.Duration != 0 && (time.Duration(c.Duration) < 15*time.Minute || time.Duration(c.Duration) > 12*time.Hour):
+		return errors.New("role duration must be between 15m and 12h")
+	}
+	return nil
+}
+
+// source describes where the credentials come from, for logging
+func (c *CredentialsConfig) source() string {
+	switch {
+	case c == nil:
+		return "default"
+	case c.Anonymous:
+		return "anonymous"
+	case c.WebIdentityTokenFile != "":
+		return "web_identity"
+	case c.RoleARN != "":
+		return "assume_role"
+	}
+	return "static"
+}
+
+// baseCredentials returns the static or anonymous credentials, or nil for the default chain
+func (c CredentialsConfig) baseCredentials() (*credentials.Credentials, error) {
+	if c.Anonymous {
+		return credentials.AnonymousCredentials, nil
+	}
+	if c.AccessKeyID == "" {
+		return nil, nil
+	}
+
+	var values []string
+	for _, value := range []string{c.AccessKeyID, c.SecretAccessKey, c.SessionToken} {
+		resolved, err := resolveCredentialValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("reading credentials: %v", err)
+		}
+		values = append(values, resolved)
+	}
+	if values[0] == "" || values[1] == "" {
+		return nil, errors.New("access key id or secret access key is empty")
+	}
+	return credentials.NewStaticCredentials(values[0], values[1], values[2]), nil
+}
+
+// assumeRole returns a copy of sess using credentials of the role, got with the credentials of sess
+func (c CredentialsConfig) assumeRole(sess *session.Session, log *zap.Logger) (*session.Session, error) {
+	var resolved []string
+	for _, value := range []string{c.RoleARN, c.ExternalID, c.SessionName, c.WebIdentityTokenFile} {
+		value, err := resolveCredentialValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("reading role config: %v", err)
+		}
+		resolved = append(resolved, value)
+	}
+	roleARN, externalID, sessionName, tokenFile := resolved[0], resolved[1], resolved[2], resolved[3]
+
+	stsClient := sts.New(sess)
+	var provider credentials.Provider
+	if tokenFile != "" {
+		provider = stscreds.NewWebIdentityRoleProviderWithOptions(stsClient, roleARN, sessionName,
+			stscreds.FetchTokenPath(tokenFile), func(p *stscreds.WebIdentityRoleProvider) {
+				p.Duration = time.Duration(c.Duration)
+				p.ExpiryWindow = credentialsExpiryWindow
+			})
+	} else {
+		provider = &stscreds.AssumeRoleProvider{
+			Client:          stsClient,
+			RoleARN:         roleARN,
+			RoleSessionName: sessionName,
+			ExternalID:      makeAwsString(externalID),
+			Duration:        time.Duration(c.Duration),
+			ExpiryWindow:    credentialsExpiryWindow,
+		}
+	}
+
+	creds := credentials.NewCredentials(&loggingProvider{
+		Provider: provider,
+		source:   roleARN,
+		log:      log,
+	})
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
+
+// loggingProvider logs every time credentials are retrieved, along with when they expire
+type loggingProvider struct {
+	credentials.Provider
+	source string
+	log    *zap.Logger
+}
+
+func (l *loggingProvider) Retrieve() (credentials.Value, error) {
+	value, err := l.Provider.Retrieve()
+	if err != nil {
+		l.log.Error("could not retrieve credentials",
+			zap.String("source", l.source),
+			zap.String("err", err.Error()),
+		)
+		return value, err
+	}
+	l.log.Info("retrieved credentials",
+		zap.String("source", l.source),
+		zap.String("provider", value.ProviderName),
+		zap.Time("expires", l.ExpiresAt()),
+	)
+	return value, nil
+}
+
+// ExpiresAt returns when the credentials expire, or the zero time if the provider can't tell
+func (l *loggingProvider) ExpiresAt() time.Time {
+	if expirer, ok := l.Provider.(credentials.Expirer); ok {
+		return expirer.ExpiresAt()
+	}
+	return time.Time{}
+}
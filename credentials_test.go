@@ -0,0 +1,168 @@
+package caddys3proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestResolveCredentialValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("S3PROXY_TEST_KEY", "from-env")
+	defer os.Unsetenv("S3PROXY_TEST_KEY")
+
+	for value, expected := range map[string]string{
+		"plain":                     "plain",
+		"{env.S3PROXY_TEST_KEY}":    "from-env",
+		"{file." + secretFile + "}": "from-file",
+		"":                          "",
+	} {
+		resolved, err := resolveCredentialValue(value)
+		if err != nil {
+			t.Errorf("Resolving '%s': %v", value, err)
+		}
+		if resolved != expected {
+			t.Errorf("Expected '%s' to resolve to '%s', got '%s'", value, expected, resolved)
+		}
+	}
+
+	if _, err := resolveCredentialValue("{file." + filepath.Join(dir, "missing") + "}"); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestCredentialsValidate(t *testing.T) {
+	testCases := []struct {
+		name      string
+		config    CredentialsConfig
+		errString string
+	}{
+		{name: "static", config: CredentialsConfig{AccessKeyID: "id", SecretAccessKey: "secret"}},
+		{name: "role", config: CredentialsConfig{RoleARN: "arn", ExternalID: "x", Duration: caddy.Duration(time.Hour)}},
+		{name: "web identity", config: CredentialsConfig{RoleARN: "arn", WebIdentityTokenFile: "/token"}},
+		{name: "anonymous", config: CredentialsConfig{Anonymous: true}},
+		{
+			name:      "anonymous with keys",
+			config:    CredentialsConfig{Anonymous: true, AccessKeyID: "id", SecretAccessKey: "secret"},
+			errString: "anonymous credentials can not be used",
+		},
+		{
+			name:      "missing secret",
+			config:    CredentialsConfig{AccessKeyID: "id"},
+			errString: "needs both an access key id and a secret access key",
+		},
+		{
+			name:      "external id without role",
+			config:    CredentialsConfig{ExternalID: "x"},
+			errString: "need a role_arn",
+		},
+		{
+			name:      "web identity with keys",
+			config:    CredentialsConfig{RoleARN: "arn", WebIdentityTokenFile: "/token", AccessKeyID: "id", SecretAccessKey: "secret"},
+			errString: "can not be used with an access key",
+		},
+		{
+			name:      "duration",
+			config:    CredentialsConfig{RoleARN: "arn", Duration: caddy.Duration(time.Minute)},
+			errString: "between 15m and 12h",
+		},
+	}
+
+	for _, tc := range testCases {
+		err := tc.config.validate()
+		if tc.errString == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.errString) {
+			t.Errorf("%s: expected error containing '%s', got %v", tc.name, tc.errString, err)
+		}
+	}
+}
+
+func TestBaseCredentials(t *testing.T) {
+	creds, err := CredentialsConfig{}.baseCredentials()
+	if err != nil || creds != nil {
+		t.Errorf("Expected no credentials without keys, got %v %v", creds, err)
+	}
+
+	creds, err = CredentialsConfig{Anonymous: true}.baseCredentials()
+	if err != nil || creds != credentials.AnonymousCredentials {
+		t.Errorf("Expected anonymous credentials, got %v %v", creds, err)
+	}
+
+	creds, err = CredentialsConfig{AccessKeyID: "id", SecretAccessKey: "secret", SessionToken: "token"}.baseCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value.AccessKeyID != "id" || value.SecretAccessKey != "secret" || value.SessionToken != "token" {
+		t.Errorf("Unexpected static credentials %v", value)
+	}
+
+	os.Unsetenv("S3PROXY_TEST_UNSET")
+	if _, err := (CredentialsConfig{AccessKeyID: "id", SecretAccessKey: "{env.S3PROXY_TEST_UNSET}"}).baseCredentials(); err == nil {
+		t.Error("Expected an error for an empty secret")
+	}
+}
+
+type testProvider struct {
+	expires time.Time
+	err     error
+}
+
+func (p *testProvider) Retrieve() (credentials.Value, error) {
+	return credentials.Value{AccessKeyID: "id", SecretAccessKey: "secret", ProviderName: "test"}, p.err
+}
+
+func (p *testProvider) IsExpired() bool {
+	return time.Now().After(p.expires)
+}
+
+func (p *testProvider) ExpiresAt() time.Time {
+	return p.expires
+}
+
+func TestLoggingProvider(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	provider := &testProvider{expires: expires}
+	creds := credentials.NewCredentials(&loggingProvider{Provider: provider, source: "test", log: zap.NewNop()})
+
+	if _, err := creds.Get(); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt, err := creds.ExpiresAt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiresAt.Equal(expires) {
+		t.Errorf("Expected expiry %v, got %v", expires, expiresAt)
+	}
+
+	provider.err = errors.New("denied")
+	creds.Expire()
+	if _, err := creds.Get(); err == nil {
+		t.Error("Expected the error of the provider")
+	}
+}
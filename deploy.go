@@ -0,0 +1,410 @@
+package caddys3proxy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDeployConcurrency = 8
+	defaultDeployMaxSize     = 1 << 30
+	defaultDeployMaxExtract  = 4 << 30
+)
+
+// DeployedFile describes one object written from an archive.
+type DeployedFile struct {
+	Key  string `json:"key"`
+	ETag string `json:"etag"`
+	Size int64  `json:"size"`
+}
+
+// DeployManifest is the response of a deploy.
+type DeployManifest struct {
+	Prefix  string         `json:"prefix"`
+	Files   []DeployedFile `json:"files"`
+	Skipped []string       `json:"skipped,omitempty"`
+}
+
+// deployJob is one archive entry waiting to be written. open can be called more than once,
+// done releases what the entry holds once it has been written (or failed to).
+type deployJob struct {
+	key  string
+	size int64
+	open func() (io.ReadCloser, error)
+	done func()
+}
+
+// errDeployTooLarge is returned once an archive or what it extracts to is over the limits
+var errDeployTooLarge = caddyhttp.Error(http.StatusRequestEntityTooLarge, errors.New("archive is too large"))
+
+// cappedReader fails with errDeployTooLarge, and nothing read, once there are more than left bytes
+type cappedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > c.left+1 {
+		p = p[:c.left+1]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if c.left < 0 {
+		return 0, errDeployTooLarge
+	}
+	return n, err
+}
+
+// archiveType returns "zip", "tar" or "tar.gz" for an archive content type, or "" otherwise.
+func archiveType(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/zip", "application/x-zip-compressed":
+		return "zip"
+	case "application/gzip", "application/x-gzip", "application/x-gtar":
+		return "tar.gz"
+	case "application/x-tar":
+		return "tar"
+	}
+	return ""
+}
+
+// deployEntryKey returns the key an archive entry is written to, refusing
+// any entry that would land outside of dirKey.
+func deployEntryKey(dirKey string, name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("archive entry '%s' has an absolute path", name)
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("archive entry '%s' is outside the target prefix", name)
+		}
+	}
+	cleaned := path.Clean(name)
+	if cleaned == "." {
+		return "", fmt.Errorf("archive entry '%s' has no name", name)
+	}
+	return path.Join(dirKey, cleaned), nil
+}
+
+// DeployHandler extracts a .tar.gz, .tar or .zip body into the prefix dirKey with parallel
+// uploads and answers with a JSON manifest of what was written.
+func (p S3Proxy) DeployHandler(w http.ResponseWriter, r *http.Request, dirKey string) error {
+	concurrency := p.DeployConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultDeployConcurrency
+	}
+	maxSize := p.DeployMaxSize
+	if maxSize <= 0 {
+		maxSize = defaultDeployMaxSize
+	}
+	maxExtract := p.DeployMaxExtract
+	if maxExtract <= 0 {
+		maxExtract = defaultDeployMaxExtract
+	}
+
+	// Uploads still running are stopped once one of them failed
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// One part at a time per entry, so each worker holds at most one part in memory
+	uploader := s3manager.NewUploaderWithClient(p.client, func(u *s3manager.Uploader) {
+		u.Concurrency = 1
+	})
+
+	manifest := DeployManifest{Prefix: strings.TrimPrefix(dirKey, "/")}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	slots := make(chan struct{}, concurrency)
+
+	// dispatch runs a job once a worker is free. As the next entry is only read after that,
+	// this also bounds how many entries are held at once.
+	dispatch := func(job deployJob) {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				job.done()
+				<-slots
+				wg.Done()
+			}()
+			file, err := p.deployFile(ctx, uploader, job)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+			manifest.Files = append(manifest.Files, file)
+		}()
+	}
+
+	// queue checks an entry and either skips it or prepares it and hands it to a worker.
+	// It stops the extraction once a worker failed or the entries are over the limit.
+	var extracted int64
+	queue := func(name string, size int64, prepare func() (deployJob, error)) error {
+		mu.Lock()
+		err := firstErr
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+		extracted += size
+		if extracted > maxExtract {
+			return errDeployTooLarge
+		}
+		key, err := deployEntryKey(dirKey, name)
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		if fileHidden(key, p.Hide) {
+			manifest.Skipped = append(manifest.Skipped, strings.TrimPrefix(key, "/"))
+			return nil
+		}
+		job, err := prepare()
+		if err != nil {
+			return err
+		}
+		job.key = key
+		dispatch(job)
+		return nil
+	}
+
+	body := &cappedReader{r: r.Body, left: maxSize}
+	var err error
+	switch archiveType(r.Header.Get("Content-Type")) {
+	case "zip":
+		// zip needs random access, so spool it to a temp file first
+		var tmp *os.File
+		tmp, err = ioutil.TempFile("", "s3proxy-deploy-*.zip")
+		if err != nil {
+			return convertToCaddyError(err)
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		var size int64
+		size, err = io.Copy(tmp, body)
+		if err == errDeployTooLarge {
+			return err
+		}
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		err = queueZip(tmp, size, maxExtract, queue)
+	case "tar.gz":
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(body)
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		err = queueTar(gz, queue)
+	case "tar":
+		err = queueTar(body, queue)
+	default:
+		err = caddyhttp.Error(http.StatusUnsupportedMediaType, errors.New("not an archive"))
+	}
+	if err != nil {
+		cancel()
+	}
+	wg.Wait()
+
+	if err == nil {
+		err = firstErr
+	}
+	if err != nil {
+		p.log.Error("deploy failed",
+			zap.String("bucket", p.Bucket),
+			zap.String("prefix", dirKey),
+			zap.Int("written", len(manifest.Files)),
+			zap.String("err", err.Error()),
+		)
+		return convertToCaddyError(err)
+	}
+
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Key < manifest.Files[j].Key
+	})
+
+	p.log.Info("deployed archive",
+		zap.String("bucket", p.Bucket),
+		zap.String("prefix", dirKey),
+		zap.Int("written", len(manifest.Files)),
+		zap.Int("skipped", len(manifest.Skipped)),
+	)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(manifest)
+}
+
+// deployFile streams one archive entry to S3
+func (p S3Proxy) deployFile(ctx context.Context, uploader *s3manager.Uploader, job deployJob) (DeployedFile, error) {
+	contentType := mime.TypeByExtension(path.Ext(job.key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(p.Bucket),
+		Key:         aws.String(job.key),
+		ContentType: aws.String(contentType),
+	}
+	if p.EnableSync {
+		// Keep the checksum so a later sync can tell if the file changed
+		sum, err := deploySHA256(job)
+		if err != nil {
+			return DeployedFile{}, err
+		}
+		input.Metadata = map[string]*string{sha256MetadataKey: aws.String(sum)}
+	}
+
+	body, err := job.open()
+	if err != nil {
+		return DeployedFile{}, err
+	}
+	defer body.Close()
+	input.Body = body
+
+	out, err := uploader.UploadWithContext(ctx, input)
+	if err != nil {
+		return DeployedFile{}, err
+	}
+	p.forgetNotFound(job.key)
+
+	return DeployedFile{
+		Key:  strings.TrimPrefix(job.key, "/"),
+		ETag: aws.StringValue(out.ETag),
+		Size: job.size,
+	}, nil
+}
+
+// deploySHA256 reads an entry once to hash it
+func deploySHA256(job deployJob) (string, error) {
+	body, err := job.open()
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// queueZip queues the files of a zip, which are read from it by the workers. All names and
+// sizes are checked before anything is written.
+func queueZip(body io.ReaderAt, size int64, maxExtract int64, queue func(string, int64, func() (deployJob, error)) error) error {
+	zr, err := zip.NewReader(body, size)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	var files []*zip.File
+	var extracted uint64
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if _, err := deployEntryKey("/", f.Name); err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		extracted += f.UncompressedSize64
+		if extracted > uint64(maxExtract) {
+			return errDeployTooLarge
+		}
+		files = append(files, f)
+	}
+
+	for _, f := range files {
+		f := f
+		// Reading an entry fails once it is larger than it says, so its size can be trusted
+		size := int64(f.UncompressedSize64)
+		err := queue(f.Name, size, func() (deployJob, error) {
+			return deployJob{size: size, open: f.Open, done: func() {}}, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueTar reads a tar stream and queues its regular files. Entries have to be read in order,
+// so each one is spooled to a temp file before being handed to a worker. Entries before a bad
+// one may already have been written.
+func queueTar(body io.Reader, queue func(string, int64, func() (deployJob, error)) error) error {
+	tr := tar.NewReader(body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == errDeployTooLarge {
+			return err
+		}
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		err = queue(hdr.Name, hdr.Size, func() (deployJob, error) {
+			return spoolTarEntry(tr, hdr.Size)
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// spoolTarEntry copies the current entry of tr to a temp file, removed once the job is done
+func spoolTarEntry(tr io.Reader, size int64) (deployJob, error) {
+	tmp, err := ioutil.TempFile("", "s3proxy-deploy-*")
+	if err != nil {
+		return deployJob{}, err
+	}
+	job := deployJob{
+		size: size,
+		open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(io.NewSectionReader(tmp, 0, size)), nil
+		},
+		done: func() {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		},
+	}
+	if _, err := io.Copy(tmp, tr); err != nil {
+		job.done()
+		if err == errDeployTooLarge {
+			return deployJob{}, err
+		}
+		return deployJob{}, caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	return job, nil
+}
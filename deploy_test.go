@@ -0,0 +1,261 @@
+package caddys3proxy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestDeployEntryKey(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		expected  string
+		shouldErr bool
+	}{
+		{name: "index.html", expected: "/site/index.html"},
+		{name: "./css/main.css", expected: "/site/css/main.css"},
+		{name: `js\app.js`, expected: "/site/js/app.js"},
+		{name: "../escape.html", shouldErr: true},
+		{name: "a/../../escape.html", shouldErr: true},
+		{name: "/etc/passwd", shouldErr: true},
+		{name: "./", shouldErr: true},
+	} {
+		key, err := deployEntryKey("/site/", tc.name)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Expected an error for entry '%s' but got key '%s'", tc.name, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for entry '%s': %v", tc.name, err)
+		}
+		if key != tc.expected {
+			t.Errorf("For entry '%s' we expected '%s' but got '%s'", tc.name, tc.expected, key)
+		}
+	}
+}
+
+func TestArchiveType(t *testing.T) {
+	for contentType, expected := range map[string]string{
+		"application/zip":          "zip",
+		"application/gzip":         "tar.gz",
+		"application/x-tar":        "tar",
+		"application/x-gzip; q=1":  "tar.gz",
+		"multipart/form-data; b=1": "",
+		"":                         "",
+	} {
+		if actual := archiveType(contentType); actual != expected {
+			t.Errorf("For '%s' we expected '%s' but got '%s'", contentType, expected, actual)
+		}
+	}
+}
+
+func makeTarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDeploy(t *testing.T) {
+	client := newS3Client(t)
+	bucketName := setupTestBucket(t, client)
+
+	proxy := S3Proxy{
+		Bucket:       bucketName,
+		EnableDeploy: true,
+		Hide:         []string{".git"},
+		client:       client,
+		log:          zap.NewExample(),
+	}
+
+	files := map[string]string{
+		"index.html":    "<h1>hi</h1>",
+		"css/main.css":  "body {}",
+		".git/config":   "secret",
+		"js/app.min.js": "alert(1)",
+	}
+
+	for _, tc := range []struct {
+		name         string
+		contentType  string
+		body         []byte
+		expectedCode int
+	}{
+		{name: "targz", contentType: "application/gzip", body: makeTarGz(t, files), expectedCode: http.StatusOK},
+		{name: "zip", contentType: "application/zip", body: makeZip(t, files), expectedCode: http.StatusOK},
+		{name: "zip-traversal", contentType: "application/zip", body: makeZip(t, map[string]string{"../x": "x"}), expectedCode: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/deploy-"+tc.name+"/", bytes.NewReader(tc.body))
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			req.Header.Set("Content-Type", tc.contentType)
+			recorder := httptest.NewRecorder()
+			_ = proxy.ServeHTTP(recorder, req, nil)
+
+			if recorder.Code != tc.expectedCode {
+				t.Fatalf("Expected code %d, got %d", tc.expectedCode, recorder.Code)
+			}
+			if tc.expectedCode != http.StatusOK {
+				return
+			}
+
+			var manifest DeployManifest
+			if err := json.NewDecoder(recorder.Body).Decode(&manifest); err != nil {
+				t.Fatal(err)
+			}
+			if len(manifest.Files) != 3 || len(manifest.Skipped) != 1 {
+				t.Errorf("Expected 3 files written and 1 skipped, got %+v", manifest)
+			}
+			if manifest.Files[0].Key != "deploy-"+tc.name+"/css/main.css" || manifest.Files[0].ETag == "" {
+				t.Errorf("Unexpected first file in manifest: %+v", manifest.Files[0])
+			}
+		})
+	}
+}
+
+func TestDeployLimits(t *testing.T) {
+	var puts int32
+	failPuts := false
+	stub, client := newStubS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&puts, 1)
+		ioutil.ReadAll(r.Body)
+		if failPuts {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+	})
+	defer stub.Close()
+
+	files := map[string]string{}
+	for i := 0; i < 10; i++ {
+		files[fmt.Sprintf("file%d.txt", i)] = "0123456789"
+	}
+
+	for _, tc := range []struct {
+		name         string
+		contentType  string
+		body         []byte
+		proxy        S3Proxy
+		failPuts     bool
+		expectedCode int
+		maxPuts      int32
+	}{
+		{
+			name:         "zip under the limits",
+			contentType:  "application/zip",
+			body:         makeZip(t, files),
+			proxy:        S3Proxy{DeployMaxSize: 1 << 20, DeployMaxExtract: 100},
+			expectedCode: http.StatusOK,
+			maxPuts:      10,
+		},
+		{
+			name:         "zip too large",
+			contentType:  "application/zip",
+			body:         makeZip(t, files),
+			proxy:        S3Proxy{DeployMaxSize: 100},
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:         "zip extracts too much",
+			contentType:  "application/zip",
+			body:         makeZip(t, files),
+			proxy:        S3Proxy{DeployMaxExtract: 99},
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:         "tar too large",
+			contentType:  "application/gzip",
+			body:         makeTarGz(t, files),
+			proxy:        S3Proxy{DeployMaxSize: 20},
+			expectedCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:         "tar extracts too much",
+			contentType:  "application/gzip",
+			body:         makeTarGz(t, files),
+			proxy:        S3Proxy{DeployMaxExtract: 55},
+			expectedCode: http.StatusRequestEntityTooLarge,
+			maxPuts:      5,
+		},
+		{
+			name:         "stops on the first error",
+			contentType:  "application/gzip",
+			body:         makeTarGz(t, files),
+			proxy:        S3Proxy{DeployConcurrency: 1},
+			failPuts:     true,
+			expectedCode: http.StatusInternalServerError,
+			maxPuts:      2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&puts, 0)
+			failPuts = tc.failPuts
+			proxy := tc.proxy
+			proxy.Bucket = "mybucket"
+			proxy.EnableDeploy = true
+			proxy.client = client
+			proxy.log = zap.NewNop()
+
+			req := httptest.NewRequest(http.MethodPost, "/site/", bytes.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			err := proxy.DeployHandler(httptest.NewRecorder(), req, "/site/")
+			code := http.StatusOK
+			if err != nil {
+				code = convertToCaddyError(err).StatusCode
+			}
+			if code != tc.expectedCode {
+				t.Errorf("Expected code %d, got %d (%v)", tc.expectedCode, code, err)
+			}
+			if n := atomic.LoadInt32(&puts); n > tc.maxPuts {
+				t.Errorf("Expected at most %d uploads, got %d", tc.maxPuts, n)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package caddys3proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+const (
+	endpointPolicyRoundRobin   = "round_robin"
+	endpointPolicyLeastLatency = "least_latency"
+	endpointPolicyRandom       = "random"
+)
+
+const (
+	defaultEndpointMaxFails = 1
+	defaultEndpointCooldown = 30 * time.Second
+)
+
+// Weight of the latest request in the average latency of an endpoint
+const endpointLatencyWeight = 0.2
+
+// EndpointStatus is the state of one endpoint of a pool.
+type EndpointStatus struct {
+	Endpoint     string     `json:"endpoint"`
+	Healthy      bool       `json:"healthy"`
+	LatencyMS    float64    `json:"latency_ms"`
+	Failures     int        `json:"failures"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+}
+
+// endpointNode is one endpoint of a pool and the client sending requests to it
+type endpointNode struct {
+	endpoint string
+	client   *s3.S3
+
+	mu           sync.Mutex
+	latency      time.Duration
+	failures     int
+	ejectedUntil time.Time
+}
+
+// endpointPool spreads requests over several S3-compatible endpoints, like the nodes of a MinIO
+// cluster. Endpoints failing max fails requests in a row are left out for the cooldown.
+type endpointPool struct {
+	policy   string
+	maxFails int
+	cooldown time.Duration
+	log      *zap.Logger
+
+	next  uint32
+	nodes []*endpointNode
+}
+
+func newEndpointPool(sess *session.Session, endpoints []string, policy string, maxFails int, cooldown time.Duration, log *zap.Logger) *endpointPool {
+	if policy == "" {
+		policy = endpointPolicyRoundRobin
+	}
+	if maxFails <= 0 {
+		maxFails = defaultEndpointMaxFails
+	}
+	if cooldown <= 0 {
+		cooldown = defaultEndpointCooldown
+	}
+
+	pool := &endpointPool{
+		policy:   policy,
+		maxFails: maxFails,
+		cooldown: cooldown,
+		log:      log,
+	}
+	for _, endpoint := range endpoints {
+		node := &endpointNode{endpoint: endpoint}
+		node.client = s3.New(sess, &aws.Config{Endpoint: aws.String(endpoint)})
+		// Only this node's client gets its outcome recorded
+		node.client.Handlers.Complete.PushBack(func(r *request.Request) {
+			pool.record(node, r)
+		})
+		pool.nodes = append(pool.nodes, node)
+	}
+	return pool
+}
+
+// healthy returns the nodes that are not ejected. If all of them are, all are returned,
+// as trying a failing node beats failing every request.
+func (p *endpointPool) healthy() []*endpointNode {
+	now := time.Now()
+	var healthy []*endpointNode
+	for _, node := range p.nodes {
+		node.mu.Lock()
+		ejected := now.Before(node.ejectedUntil)
+		node.mu.Unlock()
+		if !ejected {
+			healthy = append(healthy, node)
+		}
+	}
+	if len(healthy) == 0 {
+		return p.nodes
+	}
+	return healthy
+}
+
+// pick returns the node the next request goes to
+func (p *endpointPool) pick() *endpointNode {
+	nodes := p.healthy()
+	switch p.policy {
+	case endpointPolicyRandom:
+		return nodes[rand.Intn(len(nodes))]
+	case endpointPolicyLeastLatency:
+		best := nodes[0]
+		bestLatency := best.averageLatency()
+		for _, node := range nodes[1:] {
+			if latency := node.averageLatency(); latency < bestLatency {
+				best, bestLatency = node, latency
+			}
+		}
+		return best
+	}
+	n := atomic.AddUint32(&p.next, 1)
+	return nodes[int(n-1)%len(nodes)]
+}
+
+func (n *endpointNode) averageLatency() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.latency
+}
+
+// record is a Complete handler counting the outcome of a request to node. Canceled requests
+// are not counted, neither as failures nor for the latency.
+func (p *endpointPool) record(node *endpointNode, r *request.Request) {
+	if requestCanceled(r) {
+		return
+	}
+	failed := requestFailed(r)
+	latency := time.Since(r.Time)
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.latency == 0 {
+		node.latency = latency
+	} else {
+		node.latency = time.Duration(endpointLatencyWeight*float64(latency) + (1-endpointLatencyWeight)*float64(node.latency))
+	}
+
+	if !failed {
+		node.failures = 0
+		return
+	}
+	node.failures++
+	if node.failures >= p.maxFails && !time.Now().Before(node.ejectedUntil) {
+		node.ejectedUntil = time.Now().Add(p.cooldown)
+		p.log.Warn("endpoint ejected",
+			zap.String("endpoint", node.endpoint),
+			zap.Int("failures", node.failures),
+			zap.Time("ejected_until", node.ejectedUntil),
+		)
+	}
+}
+
+// status returns the state of every endpoint
+func (p *endpointPool) status() []EndpointStatus {
+	now := time.Now()
+	statuses := make([]EndpointStatus, 0, len(p.nodes))
+	for _, node := range p.nodes {
+		node.mu.Lock()
+		status := EndpointStatus{
+			Endpoint:  node.endpoint,
+			Healthy:   !now.Before(node.ejectedUntil),
+			LatencyMS: float64(node.latency) / float64(time.Millisecond),
+			Failures:  node.failures,
+		}
+		if !status.Healthy {
+			ejectedUntil := node.ejectedUntil.UTC()
+			status.EjectedUntil = &ejectedUntil
+		}
+		node.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// validateEndpoints checks the endpoint pool options
+func (p S3Proxy) validateEndpoints() error {
+	if len(p.Endpoints) == 0 {
+		if p.EndpointPolicy != "" || p.EndpointMaxFails != 0 || p.EndpointCooldown != 0 {
+			return fmt.Errorf("endpoint policy, max fails and cooldown need a list of endpoints")
+		}
+		return nil
+	}
+	if p.Endpoint != "" {
+		return fmt.Errorf("endpoint and endpoints can not both be set")
+	}
+	if hasPlaceholder(p.Region) {
+		return fmt.Errorf("endpoints can not be used with a region placeholder")
+	}
+	for _, endpoint := range p.Endpoints {
+		if hasPlaceholder(endpoint) {
+			return fmt.Errorf("endpoint '%s' can not have placeholders in a list of endpoints", endpoint)
+		}
+	}
+	switch p.EndpointPolicy {
+	case "", endpointPolicyRoundRobin, endpointPolicyLeastLatency, endpointPolicyRandom:
+	default:
+		return fmt.Errorf("endpoint policy '%s' must be round_robin, least_latency or random", p.EndpointPolicy)
+	}
+	if p.EndpointMaxFails < 0 || p.EndpointCooldown < 0 {
+		return fmt.Errorf("endpoint max fails and cooldown can not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package caddys3proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+func TestEndpointPool(t *testing.T) {
+	var goodRequests, badRequests int32
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&goodRequests, 1)
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&badRequests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	sess := newStubSession(t, "")
+
+	head := func(pool *endpointPool) error {
+		_, err := pool.pick().client.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String("mybucket"),
+			Key:    aws.String("key"),
+		})
+		return err
+	}
+
+	t.Run("round robin ejects failing endpoint", func(t *testing.T) {
+		atomic.StoreInt32(&goodRequests, 0)
+		atomic.StoreInt32(&badRequests, 0)
+		pool := newEndpointPool(sess, []string{good.URL, bad.URL}, "", 2, time.Minute, zap.NewNop())
+
+		for i := 0; i < 10; i++ {
+			head(pool)
+		}
+		// The bad endpoint gets every other request until it failed twice
+		if n := atomic.LoadInt32(&badRequests); n != 2 {
+			t.Errorf("Expected 2 requests to the failing endpoint, got %d", n)
+		}
+		if n := atomic.LoadInt32(&goodRequests); n != 8 {
+			t.Errorf("Expected 8 requests to the healthy endpoint, got %d", n)
+		}
+
+		status := pool.status()
+		if !status[0].Healthy || status[1].Healthy || status[1].EjectedUntil == nil {
+			t.Errorf("Unexpected status %+v", status)
+		}
+	})
+
+	t.Run("all ejected still picks", func(t *testing.T) {
+		pool := newEndpointPool(sess, []string{bad.URL}, endpointPolicyRandom, 1, time.Minute, zap.NewNop())
+		head(pool)
+		if pool.pick() == nil {
+			t.Error("Expected a node even with every endpoint ejected")
+		}
+	})
+
+	t.Run("canceled requests don't eject", func(t *testing.T) {
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}))
+		defer slow.Close()
+		pool := newEndpointPool(sess, []string{slow.URL}, "", 1, time.Minute, zap.NewNop())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		_, err := pool.pick().client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String("mybucket"),
+			Key:    aws.String("key"),
+		})
+		if err == nil {
+			t.Fatal("Expected the request to be canceled")
+		}
+		if status := pool.status(); !status[0].Healthy || status[0].Failures != 0 {
+			t.Errorf("Expected a canceled request not to count as a failure, got %+v", status[0])
+		}
+	})
+
+	t.Run("least latency", func(t *testing.T) {
+		pool := newEndpointPool(sess, []string{good.URL, bad.URL}, endpointPolicyLeastLatency, 1, time.Minute, zap.NewNop())
+		pool.nodes[0].latency = 50 * time.Millisecond
+		pool.nodes[1].latency = 10 * time.Millisecond
+		if node := pool.pick(); node.endpoint != bad.URL {
+			t.Errorf("Expected the fastest endpoint, got %s", node.endpoint)
+		}
+		head(pool)
+		if node := pool.pick(); node.endpoint != good.URL {
+			t.Errorf("Expected the ejected endpoint to be skipped, got %s", node.endpoint)
+		}
+	})
+}
@@ -1,9 +1,11 @@
 package caddys3proxy
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 )
 
@@ -70,6 +72,8 @@ var awsErrorCodesMapping = map[string]int{
 	"NoSuchLifecycleConfiguration":                   http.StatusNotFound,
 	"NoSuchUpload":                                   http.StatusNotFound,
 	"NoSuchVersion":                                  http.StatusNotFound,
+	"NotFound":                                       http.StatusNotFound, // HEAD responses have no body to carry a more specific code
+	"Forbidden":                                      http.StatusForbidden,
 	"NotImplemented":                                 http.StatusNotImplemented,
 	"NotSignedUp":                                    http.StatusForbidden,
 	"OperationAborted":                               http.StatusConflict,
@@ -117,3 +121,23 @@ func convertToCaddyError(err error) caddyhttp.HandlerError {
 	// Any other error is a 500
 	return caddyhttp.Error(http.StatusInternalServerError, err)
 }
+
+// requestCanceled returns true if an S3 request was canceled by the proxy (like the loser of
+// a hedged GET) or by a client going away. That says nothing about the health of S3.
+func requestCanceled(r *request.Request) bool {
+	if aerr, ok := r.Error.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+		return true
+	}
+	return r.Context().Err() == context.Canceled
+}
+
+// requestFailed returns true if S3 failed to answer a request that was not canceled
+func requestFailed(r *request.Request) bool {
+	if r.Error == nil || requestCanceled(r) {
+		return false
+	}
+	// A status of 0 means no answer was received at all
+	return r.HTTPResponse == nil ||
+		r.HTTPResponse.StatusCode == 0 ||
+		r.HTTPResponse.StatusCode >= http.StatusInternalServerError
+}
@@ -0,0 +1,192 @@
+package caddys3proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const defaultHealthInterval = 10 * time.Second
+
+// How long a health probe may take before the bucket counts as unreachable
+const healthProbeTimeout = 5 * time.Second
+
+// HealthStatus is the answer of the health endpoint.
+type HealthStatus struct {
+	Status            string                   `json:"status"`
+	Bucket            string                   `json:"bucket"`
+	Canary            string                   `json:"canary,omitempty"`
+	CheckedAt         time.Time                `json:"checked_at"`
+	LatencyMS         float64                  `json:"latency_ms"`
+	Error             string                   `json:"error,omitempty"`
+	LastError         string                   `json:"last_error,omitempty"`
+	LastErrorAt       *time.Time               `json:"last_error_at,omitempty"`
+	CredentialsExpire *time.Time               `json:"credentials_expire,omitempty"`
+	Breakers          map[string]BreakerStatus `json:"breakers,omitempty"`
+	Endpoints         []EndpointStatus         `json:"endpoints,omitempty"`
+}
+
+// healthProbe is the last probe of one bucket
+type healthProbe struct {
+	checkedAt   time.Time
+	latency     time.Duration
+	err         error
+	lastErr     error
+	lastErrorAt time.Time
+
+	// Closed when the probe that is running finishes, nil if none is
+	running chan struct{}
+}
+
+// healthCache keeps the last probe of every bucket so the health endpoint
+// does not call S3 on every request.
+type healthCache struct {
+	interval time.Duration
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	probes map[string]*healthProbe
+}
+
+func newHealthCache(interval time.Duration) *healthCache {
+	return &healthCache{
+		interval: interval,
+		timeout:  healthProbeTimeout,
+		probes:   make(map[string]*healthProbe),
+	}
+}
+
+// probe returns the last probe of the bucket, running a new one if it is older than the interval.
+// Only one probe of a bucket runs at a time and it is given at most the probe timeout. Requests
+// arriving while it runs get the previous result, or wait for it if there is none yet.
+func (c *healthCache) probe(bucket string, run func(ctx context.Context) error) healthProbe {
+	c.mu.Lock()
+	probe, ok := c.probes[bucket]
+	if !ok {
+		probe = &healthProbe{}
+		c.probes[bucket] = probe
+	}
+	if time.Since(probe.checkedAt) < c.interval {
+		result := *probe
+		c.mu.Unlock()
+		return result
+	}
+	if probe.running != nil {
+		running := probe.running
+		if !probe.checkedAt.IsZero() {
+			result := *probe
+			c.mu.Unlock()
+			return result
+		}
+		c.mu.Unlock()
+		<-running
+		c.mu.Lock()
+		result := *probe
+		c.mu.Unlock()
+		return result
+	}
+	running := make(chan struct{})
+	probe.running = running
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	start := time.Now()
+	err := run(ctx)
+	latency := time.Since(start)
+	cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	probe.err = err
+	probe.latency = latency
+	probe.checkedAt = time.Now()
+	if err != nil {
+		probe.lastErr = err
+		probe.lastErrorAt = probe.checkedAt
+	}
+	probe.running = nil
+	close(running)
+	return *probe
+}
+
+// probeBucket runs a HeadObject on the canary key, or a HeadBucket if there is none
+func (p S3Proxy) probeBucket(ctx context.Context) error {
+	if p.HealthCanary != "" {
+		_, err := p.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(p.Bucket),
+			Key:    aws.String(p.HealthCanary),
+		})
+		return err
+	}
+	_, err := p.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(p.Bucket),
+	})
+	return err
+}
+
+// HealthHandler reports if the bucket can be reached, from a cached probe, along with the state of
+// the circuit breakers. It answers 503 when the bucket can not be read from, so a load balancer
+// can stop sending requests.
+func (p S3Proxy) HealthHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+
+	probe := p.health.probe(p.Bucket, p.probeBucket)
+	status := HealthStatus{
+		Status:    "ok",
+		Bucket:    p.Bucket,
+		Canary:    p.HealthCanary,
+		CheckedAt: probe.checkedAt.UTC(),
+		LatencyMS: float64(probe.latency) / float64(time.Millisecond),
+	}
+	code := http.StatusOK
+
+	if probe.err != nil {
+		status.Status = "unavailable"
+		status.Error = probe.err.Error()
+		code = http.StatusServiceUnavailable
+		p.log.Warn("health probe failed",
+			zap.String("bucket", p.Bucket),
+			zap.String("err", probe.err.Error()),
+		)
+	}
+	if probe.lastErr != nil {
+		lastErrorAt := probe.lastErrorAt.UTC()
+		status.LastError = probe.lastErr.Error()
+		status.LastErrorAt = &lastErrorAt
+	}
+	// Not every credential provider knows when its credentials expire
+	if expires, err := p.client.Config.Credentials.ExpiresAt(); err == nil && !expires.IsZero() {
+		expires = expires.UTC()
+		status.CredentialsExpire = &expires
+	}
+
+	if p.breakers != nil {
+		status.Breakers = p.breakers.status()
+		for _, breaker := range status.Breakers {
+			// With a replica GETs are still served while the breaker is open
+			if breaker.State == breakerStateOpen && p.Replica == nil {
+				status.Status = "unavailable"
+				code = http.StatusServiceUnavailable
+			}
+		}
+	}
+
+	if p.endpoints != nil {
+		status.Endpoints = p.endpoints.status()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	return json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,129 @@
+package caddys3proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestHealthCache(t *testing.T) {
+	cache := newHealthCache(time.Minute)
+
+	runs := 0
+	failing := func(ctx context.Context) error {
+		runs++
+		return errors.New("unreachable")
+	}
+	for i := 0; i < 3; i++ {
+		probe := cache.probe("bkt", failing)
+		if probe.err == nil || probe.lastErr == nil {
+			t.Errorf("Expected the probe to have failed, got %+v", probe)
+		}
+	}
+	if runs != 1 {
+		t.Errorf("Expected one probe to run, %d did", runs)
+	}
+
+	// A good probe keeps the last error
+	cache.probes["bkt"].checkedAt = time.Time{}
+	probe := cache.probe("bkt", func(ctx context.Context) error { return nil })
+	if probe.err != nil || probe.lastErr == nil {
+		t.Errorf("Expected a good probe remembering the last error, got %+v", probe)
+	}
+}
+
+func TestHealthCacheHungProbe(t *testing.T) {
+	cache := newHealthCache(time.Nanosecond)
+	cache.timeout = 50 * time.Millisecond
+	cache.probe("bkt", func(ctx context.Context) error { return nil })
+
+	// While a probe hangs, other requests get the last result right away
+	started := make(chan struct{})
+	done := make(chan healthProbe)
+	go func() {
+		done <- cache.probe("bkt", func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}()
+	<-started
+	answered := make(chan healthProbe)
+	go func() {
+		answered <- cache.probe("bkt", func(ctx context.Context) error {
+			t.Error("Expected only one probe to run at a time")
+			return nil
+		})
+	}()
+	select {
+	case probe := <-answered:
+		if probe.err != nil {
+			t.Errorf("Expected the last result, got %v", probe.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a request not to wait for the running probe")
+	}
+	// The hung probe gives up after the timeout
+	select {
+	case probe := <-done:
+		if probe.err == nil {
+			t.Error("Expected the hung probe to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the hung probe to time out")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	client := newS3Client(t)
+	bucketName := setupTestBucket(t, client)
+
+	type testCase struct {
+		name           string
+		canary         string
+		expectedCode   int
+		expectedStatus string
+	}
+
+	testCases := []testCase{
+		{name: "head bucket", expectedCode: http.StatusOK, expectedStatus: "ok"},
+		{name: "canary", canary: "/test.json", expectedCode: http.StatusOK, expectedStatus: "ok"},
+		{name: "missing canary", canary: "/missing.txt", expectedCode: http.StatusServiceUnavailable, expectedStatus: "unavailable"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := S3Proxy{
+				Bucket:       bucketName,
+				HealthPath:   "/health-check",
+				HealthCanary: tc.canary,
+				client:       client,
+				health:       newHealthCache(time.Minute),
+				log:          zap.NewExample(),
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/health-check", nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			resp := httptest.NewRecorder()
+			_ = proxy.ServeHTTP(resp, req, nil)
+
+			if resp.Code != tc.expectedCode {
+				t.Fatalf("Expected code %d, got %d", tc.expectedCode, resp.Code)
+			}
+			var status HealthStatus
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if status.Status != tc.expectedStatus || status.Bucket != bucketName || status.CheckedAt.IsZero() {
+				t.Errorf("Unexpected status %+v", status)
+			}
+		})
+	}
+}
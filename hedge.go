@@ -0,0 +1,186 @@
+package caddys3proxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHedgeDelay  = 100 * time.Millisecond
+	defaultHedgeBudget = 0.1
+)
+
+// Most hedged requests that can be sent in a burst
+const hedgeBurst = 10
+
+// HedgeConfig sends a second GetObject when the first is slow to answer, to cut tail latency.
+type HedgeConfig struct {
+	// How long to wait for the headers of the first request before sending the second. Default is 100ms.
+	Delay caddy.Duration `json:"delay,omitempty"`
+
+	// Share of GETs that may be hedged, as a budget earned by every GET. Default is 0.1.
+	Budget float64 `json:"budget,omitempty"`
+}
+
+// hedger holds the budget of extra requests of one handler
+type hedger struct {
+	delay  time.Duration
+	budget float64
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+func newHedger(config HedgeConfig) *hedger {
+	h := &hedger{
+		delay:  time.Duration(config.Delay),
+		budget: config.Budget,
+		tokens: hedgeBurst,
+	}
+	if h.delay <= 0 {
+		h.delay = defaultHedgeDelay
+	}
+	if h.budget <= 0 {
+		h.budget = defaultHedgeBudget
+	}
+	return h
+}
+
+// earn adds the share of one GET to the budget
+func (h *hedger) earn() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens += h.budget
+	if h.tokens > hedgeBurst {
+		h.tokens = hedgeBurst
+	}
+}
+
+// spend takes one hedged request from the budget, it returns false if there is none left
+func (h *hedger) spend() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// cancelOnClose releases the context of a GetObject once its body is read or closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if err != nil {
+		c.cancel()
+	}
+	return n, err
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+type hedgeResult struct {
+	obj    *s3.GetObjectOutput
+	err    error
+	cancel context.CancelFunc
+	hedged bool
+}
+
+// hedgedGetObject sends oi, and sends it again if no answer came within the delay and the budget
+// allows it. The first answer wins and the other request is cancelled at once. A 5xx or a failed
+// request only wins if the other one fails too.
+func (p S3Proxy) hedgedGetObject(ctx aws.Context, oi *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	p.hedges.earn()
+
+	// The first request and the hedge, each with its own context so the loser can be cancelled
+	var cancels [2]context.CancelFunc
+	results := make(chan hedgeResult, 2)
+	send := func(hedged bool) {
+		reqCtx, cancel := context.WithCancel(ctx)
+		if hedged {
+			cancels[1] = cancel
+		} else {
+			cancels[0] = cancel
+		}
+		// Each request gets its own input, the SDK may set fields of it while sending
+		input := *oi
+		go func() {
+			obj, err := p.client.GetObjectWithContext(reqCtx, &input)
+			results <- hedgeResult{obj: obj, err: err, cancel: cancel, hedged: hedged}
+		}()
+	}
+	other := func(result hedgeResult) context.CancelFunc {
+		if result.hedged {
+			return cancels[0]
+		}
+		return cancels[1]
+	}
+
+	send(false)
+	timer := time.NewTimer(p.hedges.delay)
+	defer timer.Stop()
+
+	pending := 1
+	select {
+	case result := <-results:
+		return result.finish()
+	case <-timer.C:
+		if p.hedges.spend() {
+			p.log.Debug("hedging slow get",
+				zap.String("bucket", aws.StringValue(oi.Bucket)),
+				zap.String("key", aws.StringValue(oi.Key)),
+			)
+			send(true)
+			pending++
+		}
+	}
+
+	result := <-results
+	pending--
+	if pending > 0 && shouldFailover(result.err) {
+		// Give the other request its chance
+		result.cancel()
+		result = <-results
+		pending--
+	}
+	if pending > 0 {
+		other(result)()
+		go func() {
+			// The loser may still have answered before it saw the cancel
+			loser := <-results
+			if loser.obj != nil && loser.obj.Body != nil {
+				loser.obj.Body.Close()
+			}
+		}()
+		p.log.Debug("hedged get answered",
+			zap.String("key", aws.StringValue(oi.Key)),
+			zap.Bool("hedge_won", result.hedged),
+		)
+	}
+	return result.finish()
+}
+
+// finish ties the context of the request to its body, or releases it if there is none
+func (r hedgeResult) finish() (*s3.GetObjectOutput, error) {
+	if r.obj == nil || r.obj.Body == nil {
+		r.cancel()
+		return r.obj, r.err
+	}
+	r.obj.Body = &cancelOnClose{ReadCloser: r.obj.Body, cancel: r.cancel}
+	return r.obj, r.err
+}
@@ -0,0 +1,136 @@
+package caddys3proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestHedger(t *testing.T) {
+	h := newHedger(HedgeConfig{Budget: 0.5})
+	for i := 0; i < hedgeBurst; i++ {
+		if !h.spend() {
+			t.Fatalf("Expected the burst to allow hedge %d", i)
+		}
+	}
+	if h.spend() {
+		t.Error("Expected the budget to be spent")
+	}
+	h.earn()
+	if h.spend() {
+		t.Error("Expected half a request not to be enough")
+	}
+	h.earn()
+	h.earn()
+	if !h.spend() {
+		t.Error("Expected two GETs to earn a hedge")
+	}
+}
+
+func TestHedgedGetObject(t *testing.T) {
+	var requests int32
+	canceled := make(chan struct{}, 1)
+	// The first request is slow to answer, the next ones are fast
+	stub, client := newStubS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+				canceled <- struct{}{}
+			case <-time.After(2 * time.Second):
+			}
+		}
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	})
+	defer stub.Close()
+	proxy := S3Proxy{
+		client: client,
+		hedges: newHedger(HedgeConfig{Delay: caddy.Duration(50 * time.Millisecond)}),
+		log:    zap.NewNop(),
+	}
+
+	start := time.Now()
+	obj, err := proxy.getS3Object(aws.BackgroundContext(), "mybucket", "hello.txt", http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The slow request is cancelled once the hedge won, not when the answer is done with
+	select {
+	case <-canceled:
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Expected the slow request to be cancelled")
+	}
+	body, err := ioutil.ReadAll(obj.Body)
+	obj.Body.Close()
+	if err != nil || string(body) != "hello" {
+		t.Errorf("Unexpected body %q %v", body, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the hedged request to answer, took %v", elapsed)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected 2 requests, got %d", n)
+	}
+
+	// Without budget the slow request is waited for
+	atomic.StoreInt32(&requests, 0)
+	proxy.hedges.tokens = 0
+	start = time.Now()
+	obj, err = proxy.getS3Object(aws.BackgroundContext(), "mybucket", "hello.txt", http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.Body.Close()
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Expected no hedge without budget, took %v", elapsed)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected 1 request, got %d", n)
+	}
+}
+
+func TestHedgedGetObjectEndpoints(t *testing.T) {
+	var requests int32
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	}))
+	defer stub.Close()
+
+	sess := newStubSession(t, "")
+	pool := newEndpointPool(sess, []string{stub.URL}, "", 1, time.Minute, zap.NewNop())
+	proxy := S3Proxy{
+		client:    pool.pick().client,
+		endpoints: pool,
+		hedges:    newHedger(HedgeConfig{Delay: caddy.Duration(50 * time.Millisecond)}),
+		log:       zap.NewNop(),
+	}
+
+	obj, err := proxy.getS3Object(aws.BackgroundContext(), "mybucket", "hello.txt", http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.Body.Close()
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected 2 requests, got %d", n)
+	}
+
+	// The slow request is canceled once the hedge won, that must not eject the endpoint
+	time.Sleep(100 * time.Millisecond)
+	if status := pool.status(); !status[0].Healthy || status[0].Failures != 0 {
+		t.Errorf("Expected the losing request not to count as a failure, got %+v", status[0])
+	}
+}
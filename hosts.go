@@ -0,0 +1,147 @@
+package caddys3proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// labelsPlaceholder matches the {labels.N} shorthand in host prefixes
+var labelsPlaceholder = regexp.MustCompile(`\{labels\.(\d+)\}`)
+
+// validPrefixSegment is what a host label may put into a key prefix
+var validPrefixSegment = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// HostMapping maps requests for hosts matching Pattern to the key prefix Prefix.
+type HostMapping struct {
+	// A host name. A "*" label matches any one label, like "*.preview.example.com".
+	Pattern string `json:"pattern"`
+
+	// The key prefix. {labels.N} is replaced by the Nth label of the host,
+	// counting from the right like {http.request.host.labels.N}. Other placeholders work too.
+	Prefix string `json:"prefix"`
+}
+
+// HostPrefixConfig maps request hosts to key prefixes, e.g. to serve a preview site per branch.
+type HostPrefixConfig struct {
+	// Mappings are tried in order, the first matching pattern is used
+	Mappings []HostMapping `json:"mappings,omitempty"`
+
+	// Prefix to use if no mapping matches. If empty unknown hosts get a 404.
+	Fallback string `json:"fallback,omitempty"`
+
+	// Host patterns that are always refused (403)
+	Reject []string `json:"reject,omitempty"`
+}
+
+// hostMatches returns true if host matches pattern, where a "*" label matches any one label.
+func hostMatches(pattern string, host string) bool {
+	patternLabels := strings.Split(strings.ToLower(pattern), ".")
+	hostLabels := strings.Split(host, ".")
+	if len(patternLabels) != len(hostLabels) {
+		return false
+	}
+	for i, label := range patternLabels {
+		if label != "*" && label != hostLabels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// prefixFor returns the key prefix for the host of a request.
+func (c HostPrefixConfig) prefixFor(requestHost string, repl *caddy.Replacer) (string, error) {
+	host, _, err := net.SplitHostPort(requestHost)
+	if err != nil {
+		host = requestHost
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	for _, pattern := range c.Reject {
+		if hostMatches(pattern, host) {
+			return "", caddyhttp.Error(http.StatusForbidden, fmt.Errorf("host %s is rejected", host))
+		}
+	}
+
+	for _, mapping := range c.Mappings {
+		if hostMatches(mapping.Pattern, host) {
+			prefix, err := expandHostPrefix(mapping.Prefix, host, repl)
+			if err != nil {
+				return "", caddyhttp.Error(http.StatusNotFound, err)
+			}
+			return prefix, nil
+		}
+	}
+
+	if c.Fallback != "" {
+		// Placeholders in the fallback may come from the request too
+		prefix := repl.ReplaceAll(c.Fallback, "")
+		if err := checkHostPrefix(prefix); err != nil {
+			return "", caddyhttp.Error(http.StatusNotFound, err)
+		}
+		return prefix, nil
+	}
+	return "", caddyhttp.Error(http.StatusNotFound, fmt.Errorf("no prefix for host %s", host))
+}
+
+// expandHostPrefix replaces {labels.N} and other placeholders in prefix.
+// Host labels must be plain names so a host can never point outside its own prefix.
+func expandHostPrefix(prefix string, host string, repl *caddy.Replacer) (string, error) {
+	labels := strings.Split(host, ".")
+
+	var expandErr error
+	prefix = labelsPlaceholder.ReplaceAllStringFunc(prefix, func(placeholder string) string {
+		n, _ := strconv.Atoi(labelsPlaceholder.FindStringSubmatch(placeholder)[1])
+		if n >= len(labels) {
+			expandErr = fmt.Errorf("host %s has no label %d", host, n)
+			return ""
+		}
+		label := labels[len(labels)-1-n]
+		if !validPrefixSegment.MatchString(label) {
+			expandErr = fmt.Errorf("host label '%s' can not be used in a prefix", label)
+			return ""
+		}
+		return label
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+
+	prefix = repl.ReplaceAll(prefix, "")
+	if err := checkHostPrefix(prefix); err != nil {
+		return "", err
+	}
+	return prefix, nil
+}
+
+// checkHostPrefix makes sure an expanded prefix can't point outside the root.
+func checkHostPrefix(prefix string) error {
+	for _, segment := range strings.Split(prefix, "/") {
+		if segment == ".." {
+			return errors.New("prefix must not contain '..'")
+		}
+	}
+	return nil
+}
+
+// requestRoot returns the root for a request, adding the host prefix if there is one.
+func (p S3Proxy) requestRoot(r *http.Request, repl *caddy.Replacer) (string, error) {
+	root := repl.ReplaceAll(p.Root, "")
+	if p.HostPrefixes == nil {
+		return root, nil
+	}
+
+	prefix, err := p.HostPrefixes.prefixFor(r.Host, repl)
+	if err != nil {
+		return "", err
+	}
+	return path.Join("/", root, prefix), nil
+}
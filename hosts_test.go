@@ -0,0 +1,61 @@
+package caddys3proxy
+
+import (
+	"testing"
+
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+func TestHostPrefixFor(t *testing.T) {
+	c := HostPrefixConfig{
+		Mappings: []HostMapping{
+			{Pattern: "www.example.com", Prefix: "/main/"},
+			{Pattern: "*.preview.example.com", Prefix: "/{labels.3}/"},
+		},
+		Reject: []string{"admin.preview.example.com"},
+	}
+	repl := caddy.NewReplacer()
+
+	for _, tc := range []struct {
+		host         string
+		expected     string
+		expectedCode int
+	}{
+		{host: "www.example.com", expected: "/main/"},
+		{host: "WWW.Example.com:8443", expected: "/main/"},
+		{host: "feature-x.preview.example.com", expected: "/feature-x/"},
+		{host: "feature-x.preview.example.com.", expected: "/feature-x/"},
+		{host: "admin.preview.example.com", expectedCode: 403},
+		{host: "a.b.preview.example.com", expectedCode: 404},
+		{host: "preview.example.com", expectedCode: 404},
+		{host: "other.com", expectedCode: 404},
+	} {
+		prefix, err := c.prefixFor(tc.host, repl)
+		if tc.expectedCode != 0 {
+			if err == nil {
+				t.Errorf("Host '%s' expected error %d but got prefix '%s'", tc.host, tc.expectedCode, prefix)
+			} else if code := convertToCaddyError(err).StatusCode; code != tc.expectedCode {
+				t.Errorf("Host '%s' expected error %d but got %d", tc.host, tc.expectedCode, code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Host '%s' unexpected error: %v", tc.host, err)
+		}
+		if prefix != tc.expected {
+			t.Errorf("Host '%s' expected prefix '%s' but got '%s'", tc.host, tc.expected, prefix)
+		}
+	}
+
+	c.Fallback = "/default/"
+	if prefix, err := c.prefixFor("other.com", repl); err != nil || prefix != "/default/" {
+		t.Errorf("Expected the fallback prefix for an unknown host, got '%s' (%v)", prefix, err)
+	}
+
+	// A placeholder in the fallback can't point outside the root either
+	c.Fallback = "/sites/{http.vars.site}/"
+	repl.Set("http.vars.site", "..")
+	if prefix, err := c.prefixFor("other.com", repl); convertToCaddyError(err).StatusCode != 404 {
+		t.Errorf("Expected a 404 for a fallback with '..', got '%s' (%v)", prefix, err)
+	}
+}
@@ -0,0 +1,145 @@
+package caddys3proxy
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+const (
+	defaultNotFoundTTL        = 10 * time.Second
+	defaultNotFoundMaxEntries = 10000
+)
+
+// NotFoundCacheConfig remembers keys that don't exist for a short time, so GETs of them don't each cost a GetObject.
+type NotFoundCacheConfig struct {
+	// How long a key is known not to exist. Default is 10s.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+
+	// Keys remembered, least recently added ones are dropped first. Default is 10000.
+	MaxEntries int `json:"max_entries,omitempty"`
+}
+
+// notFoundCache holds keys that got a NoSuchKey, keyed by bucket and key, until they expire
+type notFoundCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type notFoundEntry struct {
+	key     string
+	expires time.Time
+}
+
+func newNotFoundCache(config NotFoundCacheConfig) *notFoundCache {
+	c := &notFoundCache{
+		ttl:        time.Duration(config.TTL),
+		maxEntries: config.MaxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+	if c.ttl <= 0 {
+		c.ttl = defaultNotFoundTTL
+	}
+	if c.maxEntries <= 0 {
+		c.maxEntries = defaultNotFoundMaxEntries
+	}
+	return c
+}
+
+func notFoundKey(bucket string, key string) string {
+	return bucket + "|" + key
+}
+
+// has returns true if key got a NoSuchKey less than the TTL ago
+func (c *notFoundCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(elem.Value.(*notFoundEntry).expires) {
+		return true
+	}
+	c.order.Remove(elem)
+	delete(c.entries, key)
+	return false
+}
+
+func (c *notFoundCache) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.entries[key]; ok {
+		c.order.Remove(old)
+	}
+	c.entries[key] = c.order.PushFront(&notFoundEntry{key: key, expires: time.Now().Add(c.ttl)})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*notFoundEntry).key)
+	}
+}
+
+func (c *notFoundCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// isNoSuchKey returns true if err says the key does not exist. Other 404s, like a NoSuchBucket,
+// are not about the key.
+func isNoSuchKey(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	if aerr.Code() == s3.ErrCodeNoSuchKey {
+		return true
+	}
+	// A 404 without a body, like the answer to a HEAD, gets its code from the status text
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && reqErr.StatusCode() == http.StatusNotFound && aerr.Code() == "NotFound"
+}
+
+// getObject gets key like getWithFailover, but answers keys known not to exist without asking S3
+func (p S3Proxy) getObject(ctx aws.Context, w http.ResponseWriter, key string, headers http.Header) (*s3.GetObjectOutput, error) {
+	if p.notFound == nil {
+		return p.getWithFailover(ctx, w, key, headers)
+	}
+
+	cacheKey := notFoundKey(p.Bucket, key)
+	if p.notFound.has(cacheKey) {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist. (cached)", nil)
+	}
+	obj, err := p.getWithFailover(ctx, w, key, headers)
+	// Only a missing key in the bucket itself is remembered. Writes to the overlays and the
+	// replica don't go through this handler, so nothing would make the key found again.
+	if isNoSuchKey(err) && len(p.Overlays) == 0 && w.Header().Get(replicaHeader) != "secondary" {
+		p.notFound.add(cacheKey)
+	}
+	return obj, err
+}
+
+// forgetNotFound drops key from the negative cache once it has been written
+func (p S3Proxy) forgetNotFound(key string) {
+	if p.notFound != nil {
+		p.notFound.forget(notFoundKey(p.Bucket, key))
+	}
+}
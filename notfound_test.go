@@ -0,0 +1,206 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestNotFoundCacheExpiry(t *testing.T) {
+	c := newNotFoundCache(NotFoundCacheConfig{TTL: caddy.Duration(50 * time.Millisecond), MaxEntries: 2})
+	c.add("a")
+	c.add("b")
+	c.add("c")
+
+	if c.has("a") {
+		t.Error("Expected the oldest key to be dropped")
+	}
+	if !c.has("b") || !c.has("c") {
+		t.Error("Expected the newest keys to be kept")
+	}
+	c.forget("b")
+	if c.has("b") {
+		t.Error("Expected a forgotten key to be dropped")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if c.has("c") {
+		t.Error("Expected an expired key to be dropped")
+	}
+}
+
+func TestNotFoundCacheGetHandler(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	gets := map[string]int{}
+	stub, client := newStubS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/mybucket/")
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			objects[key], _ = ioutil.ReadAll(r.Body)
+			w.Header().Set("ETag", `"v1"`)
+		case http.MethodGet:
+			gets[key]++
+			content, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(content)
+		}
+	})
+	defer stub.Close()
+	proxy := S3Proxy{
+		Bucket:     "mybucket",
+		IndexNames: []string{"index.html", "index.htm"},
+		EnablePut:  true,
+		client:     client,
+		notFound:   newNotFoundCache(NotFoundCacheConfig{}),
+		log:        zap.NewNop(),
+	}
+
+	get := func(key string) int {
+		w := httptest.NewRecorder()
+		err := proxy.GetHandler(w, httptest.NewRequest(http.MethodGet, key, nil), key)
+		if err != nil {
+			return convertToCaddyError(err).StatusCode
+		}
+		return http.StatusOK
+	}
+
+	for i := 0; i < 3; i++ {
+		if status := get("/missing.txt"); status != http.StatusNotFound {
+			t.Errorf("Expected a 404 for a missing key, got %d", status)
+		}
+		if status := get("/docs/"); status != http.StatusForbidden {
+			t.Errorf("Expected a 403 for a directory without an index, got %d", status)
+		}
+	}
+	mu.Lock()
+	for _, key := range []string{"missing.txt", "docs/index.html", "docs/index.htm"} {
+		if gets[key] != 1 {
+			t.Errorf("Expected one GetObject of %s, got %d", key, gets[key])
+		}
+	}
+	mu.Unlock()
+
+	// Writing a key through the proxy makes it found at once
+	for _, key := range []string{"/missing.txt", "/docs/index.htm"} {
+		r := httptest.NewRequest(http.MethodPut, key, bytes.NewReader([]byte("hello")))
+		if err := proxy.PutHandler(httptest.NewRecorder(), r, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status := get("/missing.txt"); status != http.StatusOK {
+		t.Errorf("Expected a 200 after a PUT, got %d", status)
+	}
+	if status := get("/docs/"); status != http.StatusOK {
+		t.Errorf("Expected the index to be found after a PUT, got %d", status)
+	}
+	mu.Lock()
+	if gets["docs/index.html"] != 1 {
+		t.Errorf("Expected the missing index.html to still be cached, got %d GetObjects", gets["docs/index.html"])
+	}
+	mu.Unlock()
+
+	// So does a form upload
+	if status := get("/form/hello.txt"); status != http.StatusNotFound {
+		t.Errorf("Expected a 404 before the upload, got %d", status)
+	}
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	fw, _ := mw.CreateFormFile("file", "hello.txt")
+	fw.Write([]byte("hello"))
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/form/", &form)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	if err := proxy.FormUploadHandler(httptest.NewRecorder(), r, "/form/"); err != nil {
+		t.Fatal(err)
+	}
+	if status := get("/form/hello.txt"); status != http.StatusOK {
+		t.Errorf("Expected a 200 after a form upload, got %d", status)
+	}
+}
+
+func TestNotFoundCacheOnlyPrimary(t *testing.T) {
+	var mu sync.Mutex
+	gets := map[string]int{}
+	stub, client := newStubS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		gets[r.URL.Path]++
+		mu.Unlock()
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/broken/"):
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case strings.HasPrefix(r.URL.Path, "/nobucket/"):
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchBucket</Code><Message>The specified bucket does not exist</Message></Error>`))
+		case strings.HasPrefix(r.URL.Path, "/nobody/"):
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+		}
+	})
+	defer stub.Close()
+
+	for _, tc := range []struct {
+		name     string
+		proxy    S3Proxy
+		path     string
+		expected int
+	}{
+		{name: "no such key", proxy: S3Proxy{Bucket: "mybucket"}, path: "/mybucket/missing.txt", expected: 1},
+		{name: "404 without body", proxy: S3Proxy{Bucket: "nobody"}, path: "/nobody/missing.txt", expected: 1},
+		{name: "no such bucket", proxy: S3Proxy{Bucket: "nobucket"}, path: "/nobucket/missing.txt", expected: 3},
+		{
+			name:     "missing in the overlay",
+			proxy:    S3Proxy{Bucket: "mybucket", Overlays: []OverlaySource{{Bucket: "lower"}}},
+			path:     "/lower/missing.txt",
+			expected: 3,
+		},
+		{
+			name: "missing in the replica",
+			proxy: S3Proxy{
+				Bucket:        "broken",
+				Replica:       &ReplicaConfig{Bucket: "replica"},
+				replicaClient: client,
+			},
+			path:     "/replica/missing.txt",
+			expected: 3,
+		},
+	} {
+		mu.Lock()
+		gets = map[string]int{}
+		mu.Unlock()
+		proxy := tc.proxy
+		proxy.client = client
+		proxy.notFound = newNotFoundCache(NotFoundCacheConfig{})
+		proxy.log = zap.NewNop()
+
+		for i := 0; i < 3; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+			err := proxy.GetHandler(httptest.NewRecorder(), r, "/missing.txt")
+			if status := convertToCaddyError(err).StatusCode; status != http.StatusNotFound {
+				t.Errorf("Test '%s' expected a 404, got %d", tc.name, status)
+			}
+		}
+		mu.Lock()
+		if gets[tc.path] != tc.expected {
+			t.Errorf("Test '%s' expected %d GetObjects of %s, got %d", tc.name, tc.expected, tc.path, gets[tc.path])
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,168 @@
+package caddys3proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// How long fetching an object from the origin may take, body included
+const defaultOriginTimeout = time.Minute
+
+// Headers of the origin's answer passed on to the client
+var originHeaders = []string{"Cache-Control", "Content-Disposition", "Content-Encoding", "Content-Language",
+	"Content-Length", "Content-Type", "Last-Modified"}
+
+// Not tied to the client's request, so a client going away does not stop the bucket being populated.
+// Requests are bounded by the origin timeout instead.
+var originClient = &http.Client{}
+
+// pullThroughWriter writes to the client and to the upload.
+// Failing to write to one of them does not stop the other.
+type pullThroughWriter struct {
+	client    io.Writer
+	upload    io.Writer
+	clientErr error
+	uploadErr error
+}
+
+func (t *pullThroughWriter) Write(b []byte) (int, error) {
+	if t.clientErr == nil {
+		_, t.clientErr = t.client.Write(b)
+	}
+	if t.uploadErr == nil {
+		_, t.uploadErr = t.upload.Write(b)
+	}
+	if t.clientErr != nil && t.uploadErr != nil {
+		return 0, t.clientErr
+	}
+	return len(b), nil
+}
+
+// originURL returns the URL of the request path at the origin
+func (p S3Proxy) originURL(r *http.Request) string {
+	return strings.TrimSuffix(p.Origin, "/") + r.URL.EscapedPath()
+}
+
+func (p S3Proxy) originTimeout() time.Duration {
+	if p.OriginTimeout <= 0 {
+		return defaultOriginTimeout
+	}
+	return time.Duration(p.OriginTimeout)
+}
+
+// PullThroughHandler fetches a key missing from S3 from the origin. The body is streamed to
+// the client and written to the bucket at the same time, so the next request is served from S3.
+// A Range request is passed to the origin, and a partial answer is only relayed, not stored.
+func (p S3Proxy) PullThroughHandler(w http.ResponseWriter, r *http.Request, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.originTimeout())
+	defer cancel()
+
+	originURL := p.originURL(r)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, originURL, nil)
+	if err != nil {
+		return convertToCaddyError(err)
+	}
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	resp, err := originClient.Do(req)
+	if err != nil {
+		p.log.Error("could not reach origin",
+			zap.String("url", originURL),
+			zap.String("err", err.Error()),
+		)
+		return caddyhttp.Error(http.StatusBadGateway, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return caddyhttp.Error(http.StatusNotFound, errors.New("not found at origin"))
+	case resp.StatusCode == http.StatusPartialContent && r.Header.Get("Range") != "":
+		return p.relayPartialOrigin(w, resp, originURL)
+	case resp.StatusCode != http.StatusOK:
+		return caddyhttp.Error(http.StatusBadGateway, fmt.Errorf("origin answered %d", resp.StatusCode))
+	}
+
+	// The uploader reads the body from the pipe while it is being sent to the client
+	pr, pw := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		uploader := s3manager.NewUploaderWithClient(p.client)
+		_, err := uploader.Upload(&s3manager.UploadInput{
+			Bucket:             aws.String(p.Bucket),
+			Key:                aws.String(key),
+			CacheControl:       makeAwsString(resp.Header.Get("Cache-Control")),
+			ContentDisposition: makeAwsString(resp.Header.Get("Content-Disposition")),
+			ContentEncoding:    makeAwsString(resp.Header.Get("Content-Encoding")),
+			ContentLanguage:    makeAwsString(resp.Header.Get("Content-Language")),
+			ContentType:        makeAwsString(resp.Header.Get("Content-Type")),
+			Body:               pr,
+		})
+		// Unblocks the writer if the upload stopped reading early
+		pr.CloseWithError(err)
+		uploaded <- err
+	}()
+
+	for _, name := range originHeaders {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+
+	tee := &pullThroughWriter{client: w, upload: pw}
+	n, err := io.Copy(tee, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	// An error aborts the upload, so a partial body is never stored
+	pw.CloseWithError(err)
+	uploadErr := <-uploaded
+
+	if uploadErr != nil {
+		p.log.Error("failed to store object from origin",
+			zap.String("bucket", p.Bucket),
+			zap.String("key", key),
+			zap.String("url", originURL),
+			zap.String("err", uploadErr.Error()),
+		)
+	} else {
+		p.forgetNotFound(key)
+		p.log.Info("stored object from origin",
+			zap.String("bucket", p.Bucket),
+			zap.String("key", key),
+			zap.String("url", originURL),
+			zap.Int64("size", n),
+		)
+	}
+
+	return err
+}
+
+// relayPartialOrigin sends a 206 of the origin to the client. Part of an object can't be stored,
+// so the key stays missing until a request for all of it.
+func (p S3Proxy) relayPartialOrigin(w http.ResponseWriter, resp *http.Response, originURL string) error {
+	for _, name := range append(originHeaders, "Content-Range") {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	w.WriteHeader(http.StatusPartialContent)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		p.log.Debug("could not relay range from origin",
+			zap.String("url", originURL),
+			zap.String("err", err.Error()),
+		)
+	}
+	return nil
+}
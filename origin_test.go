@@ -0,0 +1,105 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestPullThrough(t *testing.T) {
+	client := newS3Client(t)
+	bucketName := setupTestBucket(t, client)
+
+	fetched := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old/video.bin":
+			fetched++
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte("0123456789")))
+			return
+		case "/old/slow.bin":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+			return
+		case "/old/artifact.txt":
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		fetched++
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("from the origin"))
+	}))
+	defer origin.Close()
+
+	proxy := S3Proxy{
+		Bucket:        bucketName,
+		Origin:        origin.URL,
+		OriginTimeout: caddy.Duration(100 * time.Millisecond),
+		client:        client,
+		log:           zap.NewExample(),
+	}
+
+	var getRange func(target string, rangeHeader string) *httptest.ResponseRecorder
+
+	get := func(target string) *httptest.ResponseRecorder {
+		return getRange(target, "")
+	}
+	getRange = func(target string, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		recorder := httptest.NewRecorder()
+		_ = proxy.ServeHTTP(recorder, req, nil)
+		return recorder
+	}
+
+	// The first GET comes from the origin, the second from S3
+	for i := 0; i < 2; i++ {
+		resp := get("/old/artifact.txt")
+		if resp.Code != http.StatusOK || resp.Body.String() != "from the origin" {
+			t.Fatalf("Expected the origin's object, got %d %q", resp.Code, resp.Body.String())
+		}
+		if resp.Header().Get("Content-Type") != "text/plain" {
+			t.Errorf("Unexpected content type %s", resp.Header().Get("Content-Type"))
+		}
+	}
+	if fetched != 1 {
+		t.Errorf("Expected the origin to be asked once, it was asked %d times", fetched)
+	}
+
+	if resp := get("/old/missing.txt"); resp.Code != http.StatusNotFound {
+		t.Errorf("Expected %d, got %d", http.StatusNotFound, resp.Code)
+	}
+
+	// A range is relayed but not stored, so the whole object is still fetched later
+	fetched = 0
+	resp := getRange("/old/video.bin", "bytes=2-4")
+	if resp.Code != http.StatusPartialContent || resp.Body.String() != "234" || resp.Header().Get("Content-Range") != "bytes 2-4/10" {
+		t.Errorf("Expected the range from the origin, got %d %q %q", resp.Code, resp.Body.String(), resp.Header().Get("Content-Range"))
+	}
+	if resp := get("/old/video.bin"); resp.Code != http.StatusOK || resp.Body.String() != "0123456789" {
+		t.Errorf("Expected the whole object from the origin, got %d %q", resp.Code, resp.Body.String())
+	}
+	if fetched != 2 {
+		t.Errorf("Expected the origin to be asked twice, it was asked %d times", fetched)
+	}
+
+	start := time.Now()
+	if resp := get("/old/slow.bin"); resp.Code != http.StatusBadGateway {
+		t.Errorf("Expected a hung origin to be a %d, got %d", http.StatusBadGateway, resp.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the origin timeout to cut the request, it took %v", elapsed)
+	}
+}
@@ -0,0 +1,147 @@
+package caddys3proxy
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Entries of a merged listing page when the request doesn't set "max", as with S3
+const defaultListMaxKeys = 1000
+
+// OverlaySource is a bucket and key prefix looked in when a key is not in the sources above it.
+type OverlaySource struct {
+	Bucket string `json:"bucket"`
+
+	// Prefix added in front of the key looked up in Bucket
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// sourceKey is where in S3 one source keeps a key
+type sourceKey struct {
+	bucket string
+	key    string
+}
+
+// sources returns where to look for key, top layer first: the bucket itself, then the overlays in order.
+func (p S3Proxy) sources(key string) []sourceKey {
+	sources := []sourceKey{{bucket: p.Bucket, key: key}}
+	for _, overlay := range p.Overlays {
+		sources = append(sources, sourceKey{
+			bucket: overlay.Bucket,
+			key:    joinPath(path.Join("/", overlay.Prefix), key),
+		})
+	}
+	return sources
+}
+
+// getFromSources gets key from the first source that has it
+func (p S3Proxy) getFromSources(ctx aws.Context, key string, headers http.Header) (*s3.GetObjectOutput, error) {
+	var err error
+	for _, source := range p.sources(key) {
+		var obj *s3.GetObjectOutput
+		obj, err = p.getS3Object(ctx, source.bucket, source.key, headers)
+		if err == nil || convertToCaddyError(err).StatusCode != http.StatusNotFound {
+			// Anything but a 404 (like a 304) means this source has the key
+			return obj, err
+		}
+	}
+	return nil, err
+}
+
+// listSources lists one page of the "directory" key merged from every source. An entry in a higher
+// source hides an entry with the same name in the ones below. Each source is asked for one page
+// starting after the last name of the previous merged page, which is its "next" token.
+func (p S3Proxy) listSources(r *http.Request, key string) (*s3.ListObjectsV2Output, error) {
+	page := p.ConstructListObjInput(r, key)
+	maxKeys := aws.Int64Value(page.MaxKeys)
+	if maxKeys == 0 {
+		maxKeys = defaultListMaxKeys
+	}
+	after := aws.StringValue(page.ContinuationToken)
+
+	type entry struct {
+		dir *s3.CommonPrefix
+		obj *s3.Object
+	}
+	entries := make(map[string]entry)
+	// A source that has more than its page may have names missing after its last one,
+	// so the merged page can't go past the lowest of those
+	var end string
+	var sourceTruncated bool
+
+	for _, source := range p.sources(key) {
+		prefix := strings.TrimPrefix(source.key, "/")
+		input := &s3.ListObjectsV2Input{
+			Bucket:    aws.String(source.bucket),
+			Prefix:    aws.String(prefix),
+			Delimiter: aws.String("/"),
+			MaxKeys:   aws.Int64(maxKeys),
+		}
+		if after != "" {
+			startAfter := prefix + after
+			if strings.HasSuffix(after, "/") {
+				// Skip the keys rolled up in that "directory", they would only list it again
+				startAfter += string(utf8.MaxRune)
+			}
+			input.StartAfter = aws.String(startAfter)
+		}
+		result, err := p.client.ListObjectsV2(input)
+		if err != nil {
+			return nil, err
+		}
+
+		var last string
+		add := func(name string, e entry) {
+			if name > last {
+				last = name
+			}
+			if _, ok := entries[name]; !ok && name > after {
+				entries[name] = e
+			}
+		}
+		for _, dir := range result.CommonPrefixes {
+			add(strings.TrimPrefix(aws.StringValue(dir.Prefix), prefix), entry{dir: dir})
+		}
+		for _, obj := range result.Contents {
+			add(strings.TrimPrefix(aws.StringValue(obj.Key), prefix), entry{obj: obj})
+		}
+		if aws.BoolValue(result.IsTruncated) && (!sourceTruncated || last < end) {
+			end = last
+			sourceTruncated = true
+		}
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	merged := &s3.ListObjectsV2Output{MaxKeys: page.MaxKeys}
+	var count int64
+	for _, name := range names {
+		if count == maxKeys || (sourceTruncated && name > end) {
+			break
+		}
+		if e := entries[name]; e.dir != nil {
+			merged.CommonPrefixes = append(merged.CommonPrefixes, e.dir)
+		} else {
+			merged.Contents = append(merged.Contents, e.obj)
+		}
+		count++
+	}
+	// There is a next page if a name was left out, or a source has names after its page
+	truncated := count > 0 && (count < int64(len(names)) || sourceTruncated)
+	if truncated {
+		merged.NextContinuationToken = aws.String(names[count-1])
+	}
+	merged.IsTruncated = aws.Bool(truncated)
+	merged.KeyCount = aws.Int64(count)
+	return merged, nil
+}
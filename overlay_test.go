@@ -0,0 +1,178 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestOverlays(t *testing.T) {
+	client := newS3Client(t)
+	upper := setupTestBucket(t, client)
+	lower := setupTestBucket(t, client)
+
+	for _, obj := range []struct{ bucket, key, content string }{
+		{upper, "layered/patched.txt", "patched"},
+		{lower, "base/layered/patched.txt", "original"},
+		{lower, "base/layered/only-base.txt", "base"},
+	} {
+		if _, err := client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(obj.bucket),
+			Key:    aws.String(obj.key),
+			Body:   bytes.NewReader([]byte(obj.content)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	proxy := S3Proxy{
+		Bucket:       upper,
+		Overlays:     []OverlaySource{{Bucket: lower, Prefix: "base"}},
+		EnableBrowse: true,
+		client:       client,
+		log:          zap.NewExample(),
+	}
+
+	get := func(target string, contentType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Content-Type", contentType)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		recorder := httptest.NewRecorder()
+		_ = proxy.ServeHTTP(recorder, req, nil)
+		return recorder
+	}
+
+	for target, expected := range map[string]string{
+		"/layered/patched.txt":   "patched",
+		"/layered/only-base.txt": "base",
+	} {
+		resp := get(target, "")
+		if resp.Code != http.StatusOK || resp.Body.String() != expected {
+			t.Errorf("Expected %s to be %q, got %d %q", target, expected, resp.Code, resp.Body.String())
+		}
+	}
+
+	if resp := get("/layered/missing.txt", ""); resp.Code != http.StatusNotFound {
+		t.Errorf("Expected %d, got %d", http.StatusNotFound, resp.Code)
+	}
+
+	resp := get("/layered/", "application/json")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected code %d, got %d", http.StatusOK, resp.Code)
+	}
+	var page PageObj
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Count != 2 || len(page.Items) != 2 {
+		t.Fatalf("Expected 2 merged items, got %+v", page)
+	}
+	if page.Items[0].Name != "only-base.txt" || page.Items[1].Key != "layered/patched.txt" {
+		t.Errorf("Unexpected listing %+v", page.Items)
+	}
+}
+
+func TestListSourcesPaging(t *testing.T) {
+	buckets := map[string][]string{
+		"upper": {"paged/b.txt", "paged/d/x.txt"},
+		"lower": {"base/paged/a.txt", "base/paged/b.txt", "base/paged/c.txt", "base/paged/d/y.txt", "base/paged/d/z.txt", "base/paged/e.txt"},
+	}
+	var lists int32
+	// A ListObjectsV2 of sorted keys with a prefix, "/" delimiter, start-after and max-keys
+	stub, client := newStubS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lists, 1)
+		query := r.URL.Query()
+		prefix, startAfter := query.Get("prefix"), query.Get("start-after")
+		maxKeys, _ := strconv.Atoi(query.Get("max-keys"))
+
+		var body strings.Builder
+		var count int
+		var lastDir string
+		truncated := false
+		for _, key := range buckets[strings.Trim(r.URL.Path, "/")] {
+			if !strings.HasPrefix(key, prefix) || key <= startAfter {
+				continue
+			}
+			entry := "<Contents><Key>" + key + "</Key><Size>1</Size></Contents>"
+			if i := strings.Index(key[len(prefix):], "/"); i >= 0 {
+				dir := key[:len(prefix)+i+1]
+				if dir == lastDir {
+					continue
+				}
+				lastDir = dir
+				entry = "<CommonPrefixes><Prefix>" + dir + "</Prefix></CommonPrefixes>"
+			}
+			if count == maxKeys {
+				truncated = true
+				break
+			}
+			body.WriteString(entry)
+			count++
+		}
+		fmt.Fprintf(w, "<ListBucketResult><KeyCount>%d</KeyCount><IsTruncated>%t</IsTruncated>%s</ListBucketResult>",
+			count, truncated, body.String())
+	})
+	defer stub.Close()
+	proxy := S3Proxy{
+		Bucket:   "upper",
+		Overlays: []OverlaySource{{Bucket: "lower", Prefix: "base"}},
+		client:   client,
+	}
+
+	var names []string
+	target := "/paged/?max=2"
+	for pages := 0; target != ""; pages++ {
+		if pages == 5 {
+			t.Fatalf("Expected 3 pages, got more: %v", names)
+		}
+		result, err := proxy.listSources(httptest.NewRequest(http.MethodGet, target, nil), "/paged/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := aws.Int64Value(result.KeyCount); n > 2 {
+			t.Errorf("Expected at most 2 names per page, got %d", n)
+		}
+		for _, dir := range result.CommonPrefixes {
+			names = append(names, aws.StringValue(dir.Prefix))
+		}
+		for _, obj := range result.Contents {
+			names = append(names, aws.StringValue(obj.Key))
+		}
+		target = ""
+		if result.NextContinuationToken != nil {
+			target = "/paged/?max=2&next=" + url.QueryEscape(*result.NextContinuationToken)
+		}
+	}
+	sort.Strings(names)
+	expected := "base/paged/a.txt,base/paged/c.txt,base/paged/e.txt,paged/b.txt,paged/d/"
+	if strings.Join(names, ",") != expected {
+		t.Errorf("Expected %s, got %v", expected, names)
+	}
+	// Each page asks each source once
+	if n := atomic.LoadInt32(&lists); n != 6 {
+		t.Errorf("Expected 6 listings, got %d", n)
+	}
+
+	// A page holding exactly the last names has no next one
+	result, err := proxy.listSources(httptest.NewRequest(http.MethodGet, "/paged/?max=5", nil), "/paged/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := aws.Int64Value(result.KeyCount); n != 5 || result.NextContinuationToken != nil {
+		t.Errorf("Expected 5 names and no next page, got %d and %v", n, aws.StringValue(result.NextContinuationToken))
+	}
+}
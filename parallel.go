@@ -0,0 +1,210 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	defaultParallelThreshold   = 64 << 20
+	defaultParallelPartSize    = 8 << 20
+	defaultParallelConcurrency = 4
+)
+
+// A single range of a Range header, "bytes=-100" (the last 100 bytes) is not handled
+var byteRangePattern = regexp.MustCompile(`^bytes=(\d+)-(\d*)$`)
+
+// ParallelGetConfig makes large objects be fetched as several byte ranges at once.
+type ParallelGetConfig struct {
+	// Objects (or requested ranges) larger than this are fetched in parallel. Default is 64MiB.
+	// Smaller ones are fetched with one request, as without parallel_get.
+	Threshold int64 `json:"threshold,omitempty"`
+
+	// Size of each range fetched. Default is 8MiB.
+	PartSize int64 `json:"part_size,omitempty"`
+
+	// Ranges fetched at the same time. At most concurrency + 1 parts are held in memory
+	// per download. Default is 4.
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// withDefaults returns the config with zero values replaced by the defaults
+func (c ParallelGetConfig) withDefaults() ParallelGetConfig {
+	if c.Threshold <= 0 {
+		c.Threshold = defaultParallelThreshold
+	}
+	if c.PartSize <= 0 {
+		c.PartSize = defaultParallelPartSize
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = defaultParallelConcurrency
+	}
+	return c
+}
+
+// parseByteRange returns the first and last byte of a Range header, last is -1 for an open range.
+// An empty header is the whole object.
+func parseByteRange(header string) (int64, int64, bool) {
+	if header == "" {
+		return 0, -1, true
+	}
+	match := byteRangePattern.FindStringSubmatch(header)
+	if match == nil {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end := int64(-1)
+	if match[2] != "" {
+		end, err = strconv.ParseInt(match[2], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+	}
+	return start, end, true
+}
+
+// parallelGetObject sends oi as it is, and if the answer is larger than the threshold only reads
+// the first part from it. The rest is fetched in parts at the same time, which must match the ETag
+// of the first answer. Smaller answers are streamed as they are, in one request.
+func (p S3Proxy) parallelGetObject(ctx aws.Context, oi *s3.GetObjectInput, start int64) (*s3.GetObjectOutput, error) {
+	config := p.ParallelGet.withDefaults()
+
+	obj, err := p.sendGetObject(ctx, oi)
+	if err != nil {
+		return obj, err
+	}
+	length := aws.Int64Value(obj.ContentLength)
+	if length <= config.Threshold || aws.StringValue(obj.ETag) == "" {
+		return obj, nil
+	}
+
+	last := start + length - 1
+	firstEnd := start + config.PartSize - 1
+	partsCtx, cancel := context.WithCancel(ctx)
+	fetch := func(partStart int64, partEnd int64) (*s3.GetObjectOutput, error) {
+		return p.sendGetObject(partsCtx, &s3.GetObjectInput{
+			Bucket:    oi.Bucket,
+			Key:       oi.Key,
+			VersionId: oi.VersionId,
+			Range:     aws.String(fmt.Sprintf("bytes=%d-%d", partStart, partEnd)),
+			IfMatch:   obj.ETag,
+		})
+	}
+
+	var parts []*partFetch
+	for partStart := firstEnd + 1; partStart <= last; partStart += config.PartSize {
+		partEnd := partStart + config.PartSize - 1
+		if partEnd > last {
+			partEnd = last
+		}
+		parts = append(parts, &partFetch{start: partStart, end: partEnd, done: make(chan struct{})})
+	}
+	body := &parallelBody{
+		current:     &firstPart{Reader: io.LimitReader(obj.Body, config.PartSize), Closer: obj.Body},
+		parts:       parts,
+		concurrency: config.Concurrency,
+		fetch:       fetch,
+		cancel:      cancel,
+	}
+	body.startFetches()
+	obj.Body = body
+	return obj, nil
+}
+
+// firstPart reads the first part from the answer to the whole request, closing it drops the rest
+type firstPart struct {
+	io.Reader
+	io.Closer
+}
+
+// partFetch is one range of a parallel download
+type partFetch struct {
+	start int64
+	end   int64
+
+	// Closed once data or err is set
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// parallelBody reads the first part, then the other parts in order while the next ones are fetched.
+// At most concurrency parts are fetched or waiting to be read at a time.
+type parallelBody struct {
+	current     io.ReadCloser
+	parts       []*partFetch
+	concurrency int
+	fetch       func(start int64, end int64) (*s3.GetObjectOutput, error)
+	cancel      context.CancelFunc
+
+	// Index of the next part to read, and of the next part to fetch
+	next    int
+	started int
+}
+
+// startFetches fetches parts until the window in front of the reader is full
+func (b *parallelBody) startFetches() {
+	for b.started < len(b.parts) && b.started < b.next+b.concurrency {
+		go b.fetchPart(b.parts[b.started])
+		b.started++
+	}
+}
+
+func (b *parallelBody) fetchPart(part *partFetch) {
+	defer close(part.done)
+
+	obj, err := b.fetch(part.start, part.end)
+	if err != nil {
+		part.err = err
+		return
+	}
+	defer obj.Body.Close()
+
+	part.data, part.err = ioutil.ReadAll(obj.Body)
+	if part.err == nil && int64(len(part.data)) != part.end-part.start+1 {
+		part.err = fmt.Errorf("part %d-%d: got %d bytes", part.start, part.end, len(part.data))
+	}
+}
+
+func (b *parallelBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.current.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		if b.next == len(b.parts) {
+			return n, io.EOF
+		}
+		if n > 0 {
+			return n, nil
+		}
+
+		b.current.Close()
+		part := b.parts[b.next]
+		b.next++
+		b.startFetches()
+		<-part.done
+		if part.err != nil {
+			b.current = ioutil.NopCloser(bytes.NewReader(nil))
+			return 0, part.err
+		}
+		b.current = ioutil.NopCloser(bytes.NewReader(part.data))
+	}
+}
+
+// Close stops the fetches still running
+func (b *parallelBody) Close() error {
+	b.cancel()
+	return b.current.Close()
+}
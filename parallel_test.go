@@ -0,0 +1,152 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"go.uber.org/zap"
+)
+
+func TestParseByteRange(t *testing.T) {
+	for header, expected := range map[string][3]int64{
+		"":             {0, -1, 1},
+		"bytes=0-99":   {0, 99, 1},
+		"bytes=100-":   {100, -1, 1},
+		"bytes=-100":   {0, 0, 0},
+		"bytes=0-1,5-": {0, 0, 0},
+		"bytes=9-1":    {0, 0, 0},
+	} {
+		start, end, ok := parseByteRange(header)
+		if ok != (expected[2] == 1) || (ok && (start != expected[0] || end != expected[1])) {
+			t.Errorf("parseByteRange(%q) = %d %d %v", header, start, end, ok)
+		}
+	}
+}
+
+func TestParallelGetObject(t *testing.T) {
+	objects := map[string][]byte{
+		"/mybucket/large": bytes.Repeat([]byte("0123456789"), 100),
+		"/mybucket/small": []byte("hello world"),
+		"/mybucket/empty": {},
+	}
+	var mu sync.Mutex
+	var requests int32
+	stub, client := newStubS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		mu.Lock()
+		content, ok := objects[r.URL.Path]
+		mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// Like S3, no range can be satisfied for an empty object
+		if len(content) == 0 && r.Header.Get("Range") != "" {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("ETag", `"`+sha256Hex(content)+`"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	defer stub.Close()
+	proxy := S3Proxy{
+		client:      client,
+		ParallelGet: &ParallelGetConfig{Threshold: 200, PartSize: 64, Concurrency: 3},
+		log:         zap.NewNop(),
+	}
+
+	for _, tc := range []struct {
+		name          string
+		key           string
+		rangeHeader   string
+		expected      string
+		contentRange  string
+		expectedCalls int32
+	}{
+		{
+			name:          "large in parallel",
+			key:           "large",
+			expected:      strings.Repeat("0123456789", 100),
+			expectedCalls: 16,
+		},
+		{
+			name:          "client range",
+			key:           "large",
+			rangeHeader:   "bytes=10-409",
+			expected:      strings.Repeat("0123456789", 40),
+			contentRange:  "bytes 10-409/1000",
+			expectedCalls: 7,
+		},
+		{
+			name:          "range over the part size, under the threshold",
+			key:           "large",
+			rangeHeader:   "bytes=900-",
+			expected:      strings.Repeat("0123456789", 10),
+			contentRange:  "bytes 900-999/1000",
+			expectedCalls: 1,
+		},
+		{
+			name:          "small",
+			key:           "small",
+			expected:      "hello world",
+			expectedCalls: 1,
+		},
+		{
+			name:          "empty",
+			key:           "empty",
+			expected:      "",
+			expectedCalls: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			headers := http.Header{}
+			if tc.rangeHeader != "" {
+				headers.Set("Range", tc.rangeHeader)
+			}
+			obj, err := proxy.getS3Object(aws.BackgroundContext(), "mybucket", tc.key, headers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(obj.Body)
+			obj.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tc.expected {
+				t.Errorf("Expected %d bytes %q, got %d bytes %q", len(tc.expected), tc.expected, len(body), body)
+			}
+			if aws.Int64Value(obj.ContentLength) != int64(len(tc.expected)) {
+				t.Errorf("Expected content length %d, got %d", len(tc.expected), aws.Int64Value(obj.ContentLength))
+			}
+			if aws.StringValue(obj.ContentRange) != tc.contentRange {
+				t.Errorf("Expected content range %q, got %q", tc.contentRange, aws.StringValue(obj.ContentRange))
+			}
+			if n := atomic.LoadInt32(&requests); n != tc.expectedCalls {
+				t.Errorf("Expected %d requests, got %d", tc.expectedCalls, n)
+			}
+		})
+	}
+
+	t.Run("object changed", func(t *testing.T) {
+		obj, err := proxy.getS3Object(aws.BackgroundContext(), "mybucket", "large", http.Header{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		objects["/mybucket/large"] = bytes.Repeat([]byte("x"), 1000)
+		mu.Unlock()
+		_, err = ioutil.ReadAll(obj.Body)
+		obj.Body.Close()
+		if err == nil {
+			t.Error("Expected the parts to fail once the ETag changed")
+		}
+	})
+}
@@ -0,0 +1,296 @@
+package caddys3proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPresignExpiry = 15 * time.Minute
+
+	// SigV4 presigned requests can not be valid for longer than a week
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// PresignConfig configures an endpoint that hands out presigned S3 upload URLs,
+// so clients can upload straight to S3 without the bytes going through the proxy.
+type PresignConfig struct {
+	// The request path of the endpoint
+	Path string `json:"path,omitempty"`
+
+	// Bearer tokens that are allowed to use the endpoint. At least one is needed.
+	Tokens []string `json:"tokens,omitempty"`
+
+	// Key prefixes (relative to root) uploads are allowed to. If empty any key is allowed.
+	AllowPrefixes []string `json:"allow,omitempty"`
+
+	// How long the presigned URL is valid for. Default is 15 minutes.
+	Expiry caddy.Duration `json:"expiry,omitempty"`
+
+	// Content types that may be uploaded. A type may end with "/*" to allow a whole family.
+	// If empty any content type is allowed.
+	ContentTypes []string `json:"content_types,omitempty"`
+
+	// Maximum size in bytes of an upload. 0 means no limit.
+	MaxSize int64 `json:"max_size,omitempty"`
+}
+
+// PresignRequest is the JSON body POSTed to the presign endpoint.
+type PresignRequest struct {
+	Key         string `json:"key"`
+	Method      string `json:"method"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// PresignResponse tells the client how to upload to S3.
+// For a PUT the client sends the body to URL with Headers.
+// For a POST the client sends a multipart/form-data body to URL with Fields followed by the file.
+type PresignResponse struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Key     string            `json:"key"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+	Expires time.Time         `json:"expires"`
+}
+
+func (c PresignConfig) expiry() time.Duration {
+	if c.Expiry <= 0 {
+		return defaultPresignExpiry
+	}
+	return time.Duration(c.Expiry)
+}
+
+// contentTypeAllowed returns true if contentType may be uploaded
+func (c PresignConfig) contentTypeAllowed(contentType string) bool {
+	if len(c.ContentTypes) == 0 {
+		return true
+	}
+	for _, allowed := range c.ContentTypes {
+		if allowed == contentType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePresignPrefix returns prefix with a leading "/" and no trailing "/"
+func normalizePresignPrefix(prefix string) string {
+	return "/" + strings.Trim(prefix, "/")
+}
+
+// presignKey validates the key a client asked for and returns the full key it maps to.
+func (p S3Proxy) presignKey(root string, reqKey string) (string, error) {
+	if !strings.HasPrefix(reqKey, "/") {
+		reqKey = "/" + reqKey
+	}
+	if strings.HasSuffix(reqKey, "/") {
+		return "", errors.New("key must name an object")
+	}
+	for _, segment := range strings.Split(reqKey, "/") {
+		if segment == ".." || segment == "." {
+			return "", errors.New("key must not contain '.' or '..'")
+		}
+	}
+
+	if len(p.Presign.AllowPrefixes) > 0 {
+		allowed := false
+		for _, prefix := range p.Presign.AllowPrefixes {
+			// Prefixes are normalised at provision, so "/uploads" doesn't allow "/uploads-evil/"
+			if strings.HasPrefix(reqKey, prefix+"/") {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", errors.New("key is not in an allowed prefix")
+		}
+	}
+
+	fullKey := joinPath(root, reqKey)
+	if fileHidden(fullKey, p.Hide) {
+		return "", errors.New("key is hidden")
+	}
+	return fullKey, nil
+}
+
+// PresignHandler returns a presigned PUT URL or POST policy for the key asked for.
+func (p S3Proxy) PresignHandler(w http.ResponseWriter, r *http.Request, root string) error {
+	if r.Method != http.MethodPost {
+		return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+	if !bearerAuthorized(r, p.Presign.Tokens) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return caddyhttp.Error(http.StatusUnauthorized, errors.New("not authorized to presign"))
+	}
+	if !p.EnablePut {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("uploads are not enabled"))
+	}
+
+	var req PresignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	fullKey, err := p.presignKey(root, req.Key)
+	if err != nil {
+		return caddyhttp.Error(http.StatusForbidden, err)
+	}
+	if !p.Presign.contentTypeAllowed(req.ContentType) {
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("content type '%s' is not allowed", req.ContentType))
+	}
+	if req.Size < 0 || (p.Presign.MaxSize > 0 && req.Size > p.Presign.MaxSize) {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("size is not allowed"))
+	}
+
+	var resp *PresignResponse
+	switch strings.ToUpper(req.Method) {
+	case "", http.MethodPut:
+		resp, err = p.presignPut(fullKey, req)
+	case http.MethodPost:
+		resp, err = p.presignPost(fullKey, req)
+	default:
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("can not presign method '%s'", req.Method))
+	}
+	if err != nil {
+		return convertToCaddyError(err)
+	}
+
+	p.log.Debug("presigned upload",
+		zap.String("bucket", p.Bucket),
+		zap.String("key", fullKey),
+		zap.String("method", resp.Method),
+	)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+func (p S3Proxy) presignPut(fullKey string, req PresignRequest) (*PresignResponse, error) {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(p.Bucket),
+		Key:         aws.String(fullKey),
+		ContentType: makeAwsString(req.ContentType),
+	}
+	headers := make(map[string]string)
+	if req.ContentType != "" {
+		headers["Content-Type"] = req.ContentType
+	}
+	if p.Presign.MaxSize > 0 {
+		// Signing the length is the only way to limit the size of a presigned PUT
+		input.ContentLength = aws.Int64(req.Size)
+		headers["Content-Length"] = fmt.Sprint(req.Size)
+	}
+
+	expiry := p.Presign.expiry()
+	putReq, _ := p.client.PutObjectRequest(input)
+	url, err := putReq.Presign(expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PresignResponse{
+		Method:  http.MethodPut,
+		URL:     url,
+		Key:     strings.TrimPrefix(fullKey, "/"),
+		Headers: headers,
+		Expires: time.Now().Add(expiry).UTC(),
+	}, nil
+}
+
+// presignPost builds and signs (SigV4) a POST policy for a browser form upload straight to S3.
+// See: https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-HTTPPOSTConstructPolicy.html
+func (p S3Proxy) presignPost(fullKey string, req PresignRequest) (*PresignResponse, error) {
+	creds, err := p.client.Config.Credentials.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	// Building a request resolves the bucket URL the same way as any other call
+	bucketReq, _ := p.client.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(p.Bucket)})
+	if err := bucketReq.Build(); err != nil {
+		return nil, err
+	}
+	bucketURL := *bucketReq.HTTPRequest.URL
+	bucketURL.RawQuery = ""
+
+	key := strings.TrimPrefix(fullKey, "/")
+	region := aws.StringValue(p.client.Config.Region)
+	now := time.Now().UTC()
+	expires := now.Add(p.Presign.expiry())
+	date := now.Format("20060102")
+	credential := strings.Join([]string{creds.AccessKeyID, date, region, "s3", "aws4_request"}, "/")
+
+	fields := map[string]string{
+		"key":              key,
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": credential,
+		"x-amz-date":       now.Format("20060102T150405Z"),
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+	if req.ContentType != "" {
+		fields["Content-Type"] = req.ContentType
+	}
+
+	conditions := []interface{}{
+		map[string]string{"bucket": p.Bucket},
+	}
+	for name, value := range fields {
+		conditions = append(conditions, []string{"eq", "$" + name, value})
+	}
+	if p.Presign.MaxSize > 0 {
+		conditions = append(conditions, []interface{}{"content-length-range", 0, p.Presign.MaxSize})
+	}
+
+	policy, err := json.Marshal(map[string]interface{}{
+		"expiration": expires.Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	encodedPolicy := base64.StdEncoding.EncodeToString(policy)
+
+	signingKey := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+
+	fields["policy"] = encodedPolicy
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(signingKey, encodedPolicy))
+
+	return &PresignResponse{
+		Method:  http.MethodPost,
+		URL:     bucketURL.String(),
+		Key:     key,
+		Fields:  fields,
+		Expires: expires,
+	}, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
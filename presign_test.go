@@ -0,0 +1,171 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+func TestPresignKey(t *testing.T) {
+	p := S3Proxy{
+		Hide: []string{"secret"},
+		Presign: &PresignConfig{
+			AllowPrefixes: []string{normalizePresignPrefix("/uploads/"), normalizePresignPrefix("avatars")},
+		},
+	}
+
+	for _, tc := range []struct {
+		root      string
+		key       string
+		expected  string
+		shouldErr bool
+	}{
+		{root: "", key: "/uploads/a.png", expected: "/uploads/a.png"},
+		{root: "/site", key: "uploads/a.png", expected: "/site/uploads/a.png"},
+		{root: "", key: "/avatars/me.jpg", expected: "/avatars/me.jpg"},
+		{root: "", key: "/other/a.png", shouldErr: true},
+		{root: "", key: "/uploads-evil/a.png", shouldErr: true},
+		{root: "", key: "/uploads", shouldErr: true},
+		{root: "", key: "/uploads/", shouldErr: true},
+		{root: "", key: "/uploads/../other/a.png", shouldErr: true},
+		{root: "", key: "/uploads/secret/a.png", shouldErr: true},
+	} {
+		fullKey, err := p.presignKey(tc.root, tc.key)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Expected an error for key '%s' but got '%s'", tc.key, fullKey)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for key '%s': %v", tc.key, err)
+		}
+		if fullKey != tc.expected {
+			t.Errorf("For key '%s' we expected '%s' but got '%s'", tc.key, tc.expected, fullKey)
+		}
+	}
+}
+
+func TestPresignContentTypeAllowed(t *testing.T) {
+	c := PresignConfig{ContentTypes: []string{"image/*", "application/pdf"}}
+	for contentType, expected := range map[string]bool{
+		"image/png":       true,
+		"application/pdf": true,
+		"application/zip": false,
+		"":                false,
+		"imagefoo/bar":    false,
+	} {
+		if actual := c.contentTypeAllowed(contentType); actual != expected {
+			t.Errorf("Is '%s' allowed? Got %t but expected %t", contentType, actual, expected)
+		}
+	}
+}
+
+func TestPresignHandler(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("AKIDEXAMPLE", "secret", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := S3Proxy{
+		Bucket:    "mybucket",
+		EnablePut: true,
+		Presign: &PresignConfig{
+			Path:    "/presign",
+			Tokens:  []string{"letmein"},
+			MaxSize: 1024,
+		},
+		client: s3.New(sess),
+		log:    zap.NewNop(),
+	}
+
+	for _, tc := range []struct {
+		name         string
+		token        string
+		body         string
+		expectedCode int
+		expectedURL  string
+	}{
+		{
+			name:         "needs a token",
+			body:         `{"key": "/a.txt"}`,
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "size too big",
+			token:        "letmein",
+			body:         `{"key": "/a.txt", "size": 2048}`,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "presigns a put",
+			token:        "letmein",
+			body:         `{"key": "/a.txt", "size": 10, "content_type": "text/plain"}`,
+			expectedCode: http.StatusOK,
+			expectedURL:  "https://mybucket.s3.us-west-2.amazonaws.com/a.txt?",
+		},
+		{
+			name:         "presigns a post",
+			token:        "letmein",
+			body:         `{"key": "/a.txt", "method": "POST", "size": 10}`,
+			expectedCode: http.StatusOK,
+			expectedURL:  "https://mybucket.s3.us-west-2.amazonaws.com",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/presign", bytes.NewReader([]byte(tc.body)))
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			recorder := httptest.NewRecorder()
+
+			err := p.PresignHandler(recorder, req, "")
+			code := http.StatusOK
+			if err != nil {
+				code = convertToCaddyError(err).StatusCode
+			}
+			if code != tc.expectedCode {
+				t.Fatalf("Expected code %d, got %d (%v)", tc.expectedCode, code, err)
+			}
+			if tc.expectedURL == "" {
+				return
+			}
+
+			var resp PresignResponse
+			if err := json.NewDecoder(recorder.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(resp.URL, tc.expectedURL) {
+				t.Errorf("Expected URL to start with '%s', got '%s'", tc.expectedURL, resp.URL)
+			}
+			if resp.Key != "a.txt" {
+				t.Errorf("Expected key 'a.txt', got '%s'", resp.Key)
+			}
+			if resp.Method == http.MethodPost && (resp.Fields["policy"] == "" || resp.Fields["x-amz-signature"] == "") {
+				t.Errorf("Expected a signed policy, got fields %v", resp.Fields)
+			}
+		})
+	}
+	t.Run("needs put enabled", func(t *testing.T) {
+		noPut := p
+		noPut.EnablePut = false
+		req := httptest.NewRequest(http.MethodPost, "/presign", bytes.NewReader([]byte(`{"key": "/a.txt"}`)))
+		req.Header.Set("Authorization", "Bearer letmein")
+		err := noPut.PresignHandler(httptest.NewRecorder(), req, "")
+		if code := convertToCaddyError(err).StatusCode; code != http.StatusForbidden {
+			t.Errorf("Expected code %d, got %d (%v)", http.StatusForbidden, code, err)
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package caddys3proxy
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// How long finding the region of a bucket may take
+const regionDiscoveryTimeout = 5 * time.Second
+
+// How long a failed discovery is remembered, redirects in that time fail without asking S3 again
+const regionDiscoveryRetry = 30 * time.Second
+
+// Most buckets whose region is remembered, the least recently discovered ones are dropped first
+const maxDiscoveredRegions = 1000
+
+// Region asked first when finding the region of a bucket, any region answers with the right one
+const regionDiscoveryHint = "us-east-1"
+
+// regionCache remembers the region of buckets that turned out not to be in the configured one,
+// and holds a client for each of those regions.
+type regionCache struct {
+	sess    *session.Session
+	clients *clientCache
+
+	mu      sync.Mutex
+	order   *list.List
+	regions map[string]*list.Element
+}
+
+// discoveredRegion is the region of a bucket, or why it could not be found until retryAfter
+type discoveredRegion struct {
+	bucket     string
+	region     string
+	err        error
+	retryAfter time.Time
+}
+
+func newRegionCache(sess *session.Session) *regionCache {
+	return &regionCache{
+		sess:    sess,
+		clients: newClientCache(sess),
+		order:   list.New(),
+		regions: make(map[string]*list.Element),
+	}
+}
+
+// get returns the discovered region of bucket
+func (c *regionCache) get(bucket string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.regions[bucket]
+	if !ok || elem.Value.(*discoveredRegion).err != nil {
+		return "", false
+	}
+	return elem.Value.(*discoveredRegion).region, true
+}
+
+// discover asks S3 for the region of bucket, from the x-amz-bucket-region header of a HeadBucket,
+// and remembers it. A failure is remembered for a while too, so a bucket that can't be found
+// doesn't cost a HeadBucket on every redirect.
+func (c *regionCache) discover(ctx context.Context, bucket string) (string, error) {
+	c.mu.Lock()
+	if elem, ok := c.regions[bucket]; ok {
+		found := elem.Value.(*discoveredRegion)
+		if found.err != nil && time.Now().Before(found.retryAfter) {
+			c.mu.Unlock()
+			return "", found.err
+		}
+	}
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, regionDiscoveryTimeout)
+	defer cancel()
+	region, err := s3manager.GetBucketRegion(ctx, c.sess, bucket, regionDiscoveryHint)
+	if err != nil && ctx.Err() == context.Canceled {
+		// The client went away, that says nothing about the bucket
+		return "", err
+	}
+
+	found := &discoveredRegion{bucket: bucket, region: region, err: err}
+	if err != nil {
+		found.retryAfter = time.Now().Add(regionDiscoveryRetry)
+	}
+	c.mu.Lock()
+	if old, ok := c.regions[bucket]; ok {
+		c.order.Remove(old)
+	}
+	c.regions[bucket] = c.order.PushFront(found)
+	for c.order.Len() > maxDiscoveredRegions {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.regions, oldest.Value.(*discoveredRegion).bucket)
+	}
+	c.mu.Unlock()
+	return region, err
+}
+
+// isRegionError returns true if S3 refused a request because the bucket is in another region
+func isRegionError(err error) bool {
+	if caddyErr, ok := err.(caddyhttp.HandlerError); ok {
+		err = caddyErr.Err
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusMovedPermanently {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "PermanentRedirect", "AuthorizationHeaderMalformed":
+			return true
+		}
+	}
+	return false
+}
+
+// useDiscoveredRegion switches the client of the request to the one of the region of the bucket,
+// if that was discovered to differ from the configured one.
+func (p *S3Proxy) useDiscoveredRegion() {
+	if p.regions == nil {
+		return
+	}
+	if region, ok := p.regions.get(p.Bucket); ok {
+		p.client = p.regions.clients.get(region, p.Endpoint)
+	}
+}
+
+// retryInBucketRegion discovers the region of the bucket after S3 redirected a request, and
+// runs the request again with a client for that region. Requests with a body can't be sent again,
+// they are answered with a 503 so the client retries.
+func (p S3Proxy) retryInBucketRegion(w http.ResponseWriter, r *http.Request, fullPath string, cause error) error {
+	region, err := p.regions.discover(r.Context(), p.Bucket)
+	if err != nil {
+		p.log.Error("could not discover bucket region",
+			zap.String("bucket", p.Bucket),
+			zap.String("err", err.Error()),
+		)
+		return cause
+	}
+	p.log.Warn("bucket is in another region, switching client",
+		zap.String("bucket", p.Bucket),
+		zap.String("region", region),
+	)
+	p.client = p.regions.clients.get(region, p.Endpoint)
+
+	switch r.Method {
+	case http.MethodGet:
+		return p.GetHandler(w, r, fullPath)
+	case http.MethodDelete:
+		return p.DeleteHandler(w, r, fullPath)
+	}
+	w.Header().Set("Retry-After", "1")
+	return caddyhttp.Error(http.StatusServiceUnavailable, errors.New("bucket "+p.Bucket+" moved to region "+region+", retry the request"))
+}
@@ -0,0 +1,108 @@
+package caddys3proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestIsRegionError(t *testing.T) {
+	redirect := awserr.NewRequestFailure(awserr.New("PermanentRedirect", "moved", nil), http.StatusMovedPermanently, "")
+	malformed := awserr.NewRequestFailure(awserr.New("AuthorizationHeaderMalformed", "wrong region", nil), http.StatusBadRequest, "")
+	notFound := awserr.NewRequestFailure(awserr.New("NoSuchKey", "missing", nil), http.StatusNotFound, "")
+
+	for _, tc := range []struct {
+		err      error
+		expected bool
+	}{
+		{err: redirect, expected: true},
+		{err: convertToCaddyError(redirect), expected: true},
+		{err: malformed, expected: true},
+		{err: notFound, expected: false},
+		{err: caddyhttp.Error(http.StatusNotFound, errors.New("nope")), expected: false},
+	} {
+		if isRegionError(tc.err) != tc.expected {
+			t.Errorf("Expected isRegionError(%v) to be %v", tc.err, tc.expected)
+		}
+	}
+}
+
+func TestRegionDiscovery(t *testing.T) {
+	var redirects, lostHeads int32
+	// Stands in for S3, with the bucket in eu-west-1 and lostbucket in a region that can't be found
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && r.URL.Path == "/lostbucket" {
+			atomic.AddInt32(&lostHeads, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Method == http.MethodHead && r.URL.Path == "/mybucket" {
+			w.Header().Set("X-Amz-Bucket-Region", "eu-west-1")
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+		if !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/s3/") {
+			atomic.AddInt32(&redirects, 1)
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusMovedPermanently)
+			w.Write([]byte(`<Error><Code>PermanentRedirect</Code><Message>Use the eu-west-1 endpoint</Message></Error>`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	}))
+	defer stub.Close()
+
+	sess := newStubSession(t, stub.URL)
+	proxy := S3Proxy{
+		Bucket:  "mybucket",
+		client:  s3.New(sess),
+		regions: newRegionCache(sess),
+		log:     zap.NewNop(),
+	}
+
+	serve := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/hello.txt", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		recorder := httptest.NewRecorder()
+		_ = proxy.ServeHTTP(recorder, req, nil)
+		return recorder
+	}
+
+	resp := serve(http.MethodGet)
+	if resp.Code != http.StatusOK || resp.Body.String() != "hello" {
+		t.Fatalf("Expected the object from the discovered region, got %d %s", resp.Code, resp.Body.String())
+	}
+	if region, ok := proxy.regions.get("mybucket"); !ok || region != "eu-west-1" {
+		t.Errorf("Expected eu-west-1 to be remembered, got %s", region)
+	}
+
+	// Later requests go to the right region straight away
+	serve(http.MethodGet)
+	if n := atomic.LoadInt32(&redirects); n != 1 {
+		t.Errorf("Expected a single redirect, got %d", n)
+	}
+
+	// A failed discovery is not run again on every redirect
+	proxy.Bucket = "lostbucket"
+	for i := 0; i < 3; i++ {
+		serve(http.MethodGet)
+	}
+	if n := atomic.LoadInt32(&lostHeads); n != 1 {
+		t.Errorf("Expected a single discovery, got %d", n)
+	}
+	if _, ok := proxy.regions.get("lostbucket"); ok {
+		t.Error("Expected no region for a failed discovery")
+	}
+}
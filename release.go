@@ -0,0 +1,162 @@
+package caddys3proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const defaultReleasePointerTTL = 10 * time.Second
+
+// releaseEntry is the cached value of one pointer object
+type releaseEntry struct {
+	prefix string
+	// Why the last fetch failed, only answered while there is no prefix to fall back to
+	err error
+	// When the pointer was last fetched, whether that worked or not
+	fetched time.Time
+	// Closed once the running fetch is done, nil while none is running
+	fetching chan struct{}
+}
+
+// current returns the prefix, or the error of the last fetch if there is none
+func (e *releaseEntry) current() (string, error) {
+	if e.prefix != "" {
+		return e.prefix, nil
+	}
+	return "", e.err
+}
+
+// releaseCache caches the release prefix read from pointer objects, per bucket and key.
+type releaseCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*releaseEntry
+}
+
+func newReleaseCache(ttl time.Duration) *releaseCache {
+	return &releaseCache{
+		ttl:     ttl,
+		entries: make(map[string]*releaseEntry),
+	}
+}
+
+// parseReleasePointer validates the content of a pointer object and turns it into a key prefix
+func parseReleasePointer(content string) (string, error) {
+	prefix := strings.TrimSpace(content)
+	if prefix == "" || strings.ContainsAny(prefix, "\r\n") {
+		return "", errors.New("release pointer must hold a single key prefix")
+	}
+	for _, segment := range strings.Split(prefix, "/") {
+		if segment == ".." {
+			return "", errors.New("release pointer must not contain '..'")
+		}
+	}
+	return path.Join("/", prefix), nil
+}
+
+// readReleasePointer fetches the release prefix from the pointer object
+func (p S3Proxy) readReleasePointer(pointerKey string) (string, error) {
+	obj, err := p.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(p.Bucket),
+		Key:    aws.String(pointerKey),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer obj.Body.Close()
+
+	// A pointer is tiny, anything big is not a pointer
+	buf, err := ioutil.ReadAll(io.LimitReader(obj.Body, 1025))
+	if err != nil {
+		return "", err
+	}
+	if len(buf) > 1024 {
+		return "", errors.New("release pointer is too big")
+	}
+	return parseReleasePointer(string(buf))
+}
+
+// releasePrefix returns the active release prefix, from the cache if it is fresh enough.
+// Only one request fetches the pointer at a time: while it refreshes an expired value the others
+// keep using the old one, and on a cold start they wait for it. A failed fetch is not tried again
+// before the TTL is over, and the old value is kept meanwhile.
+func (p S3Proxy) releasePrefix(repl *caddy.Replacer) (string, error) {
+	pointerKey := repl.ReplaceAll(p.ReleasePointer, "")
+	cacheKey := p.Bucket + "|" + pointerKey
+	cache := p.releases
+
+	cache.mu.Lock()
+	entry, ok := cache.entries[cacheKey]
+	if !ok {
+		entry = &releaseEntry{}
+		cache.entries[cacheKey] = entry
+	}
+	for {
+		fresh := !entry.fetched.IsZero() && time.Since(entry.fetched) < cache.ttl
+		if fresh || (entry.fetching != nil && entry.prefix != "") {
+			defer cache.mu.Unlock()
+			return entry.current()
+		}
+		if entry.fetching == nil {
+			break
+		}
+		done := entry.fetching
+		cache.mu.Unlock()
+		<-done
+		cache.mu.Lock()
+	}
+	entry.fetching = make(chan struct{})
+	cache.mu.Unlock()
+
+	prefix, err := p.readReleasePointer(pointerKey)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	close(entry.fetching)
+	entry.fetching = nil
+	entry.fetched = time.Now()
+	if err != nil {
+		p.log.Error("could not read release pointer",
+			zap.String("bucket", p.Bucket),
+			zap.String("key", pointerKey),
+			zap.String("err", err.Error()),
+		)
+		// Keep serving the release we know about
+		entry.err = caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("reading release pointer: %v", err))
+		return entry.current()
+	}
+
+	if prefix != entry.prefix {
+		p.log.Info("active release changed",
+			zap.String("bucket", p.Bucket),
+			zap.String("pointer", pointerKey),
+			zap.String("release", prefix),
+		)
+	}
+	entry.prefix = prefix
+	entry.err = nil
+	return prefix, nil
+}
+
+// releasePath prepends the active release prefix to a key
+func (p S3Proxy) releasePath(repl *caddy.Replacer, fullPath string) (string, error) {
+	prefix, err := p.releasePrefix(repl)
+	if err != nil {
+		return "", err
+	}
+	return joinPath(prefix, fullPath), nil
+}
@@ -0,0 +1,172 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestParseReleasePointer(t *testing.T) {
+	for _, tc := range []struct {
+		content   string
+		expected  string
+		shouldErr bool
+	}{
+		{content: "releases/2026-10-15/", expected: "/releases/2026-10-15"},
+		{content: "/releases/2026-10-15\n", expected: "/releases/2026-10-15"},
+		{content: "  releases/v2  ", expected: "/releases/v2"},
+		{content: "", shouldErr: true},
+		{content: "releases/a\nreleases/b", shouldErr: true},
+		{content: "../secrets/", shouldErr: true},
+	} {
+		prefix, err := parseReleasePointer(tc.content)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Expected an error for pointer '%s' but got '%s'", tc.content, prefix)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for pointer '%s': %v", tc.content, err)
+		}
+		if prefix != tc.expected {
+			t.Errorf("For pointer '%s' we expected '%s' but got '%s'", tc.content, tc.expected, prefix)
+		}
+	}
+}
+
+func TestReleasePointer(t *testing.T) {
+	client := newS3Client(t)
+	bucketName := setupTestBucket(t, client)
+
+	put := func(key string, content string) {
+		if _, err := client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte(content)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("/releases/one/page.txt", "release one")
+	put("/releases/two/page.txt", "release two")
+	put("/current", "releases/one/")
+
+	proxy := S3Proxy{
+		Bucket:         bucketName,
+		ReleasePointer: "/current",
+		client:         client,
+		releases:       newReleaseCache(time.Hour),
+		log:            zap.NewExample(),
+	}
+
+	get := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/page.txt", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		recorder := httptest.NewRecorder()
+		_ = proxy.ServeHTTP(recorder, req, nil)
+		return strings.TrimSpace(recorder.Body.String())
+	}
+
+	if body := get(); body != "release one" {
+		t.Errorf("Expected 'release one', got '%s'", body)
+	}
+
+	// The cached pointer is used until it expires
+	put("/current", "releases/two/")
+	if body := get(); body != "release one" {
+		t.Errorf("Expected the cached release 'release one', got '%s'", body)
+	}
+
+	proxy.releases.ttl = 0
+	if body := get(); body != "release two" {
+		t.Errorf("Expected 'release two' once the pointer expired, got '%s'", body)
+	}
+}
+
+func TestReleasePointerFetches(t *testing.T) {
+	var gets int32
+	var failing int32
+	stub, client := newStubS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&gets, 1)
+		time.Sleep(20 * time.Millisecond)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("releases/one/"))
+	})
+	defer stub.Close()
+	proxy := S3Proxy{
+		Bucket:         "mybucket",
+		ReleasePointer: "/current",
+		client:         client,
+		releases:       newReleaseCache(100 * time.Millisecond),
+		log:            zap.NewNop(),
+	}
+
+	// fetch asks for the prefix from n requests at once
+	fetch := func(n int) ([]string, []error) {
+		prefixes := make([]string, n)
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				prefixes[i], errs[i] = proxy.releasePrefix(caddy.NewReplacer())
+			}(i)
+		}
+		wg.Wait()
+		return prefixes, errs
+	}
+
+	// A cold start fetches the pointer once for everyone
+	prefixes, errs := fetch(10)
+	for i := range prefixes {
+		if errs[i] != nil || prefixes[i] != "/releases/one" {
+			t.Errorf("Expected /releases/one, got %q %v", prefixes[i], errs[i])
+		}
+	}
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Errorf("Expected 1 fetch on a cold start, got %d", n)
+	}
+
+	// A failed refresh keeps the old value and is not tried again until the TTL is over
+	atomic.StoreInt32(&failing, 1)
+	atomic.StoreInt32(&gets, 0)
+	time.Sleep(110 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		prefixes, errs = fetch(2)
+		if errs[0] != nil || prefixes[0] != "/releases/one" {
+			t.Errorf("Expected the old release, got %q %v", prefixes[0], errs[0])
+		}
+	}
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Errorf("Expected 1 fetch while failing, got %d", n)
+	}
+
+	// Without an old value the failure is answered until the TTL is over
+	atomic.StoreInt32(&gets, 0)
+	proxy.ReleasePointer = "/other"
+	for i := 0; i < 3; i++ {
+		_, errs = fetch(2)
+		if errs[0] == nil || convertToCaddyError(errs[0]).StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected a 503, got %v", errs[0])
+		}
+	}
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Errorf("Expected 1 fetch of a failing pointer, got %d", n)
+	}
+}
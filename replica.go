@@ -0,0 +1,102 @@
+package caddys3proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// The response header telling which replica served a GET
+const replicaHeader = "X-S3-Replica"
+
+// ReplicaConfig is a secondary bucket (usually a cross-region replica) GETs fail over to.
+type ReplicaConfig struct {
+	Bucket string `json:"bucket,omitempty"`
+
+	// Region of the replica. Defaults to the region of the primary.
+	Region string `json:"region,omitempty"`
+
+	// Endpoint of the replica. Defaults to the endpoint of the primary.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// How long to wait for the primary to start answering before failing over. 0 means no limit.
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// shouldFailover returns true if a primary error means the replica should be tried
+func shouldFailover(err error) bool {
+	return err != nil && convertToCaddyError(err).StatusCode >= http.StatusInternalServerError
+}
+
+// getFromPrimary gets key from the primary bucket (and its overlays), giving up after the replica timeout
+// or once the request is gone
+func (p S3Proxy) getFromPrimary(ctx aws.Context, key string, headers http.Header) (*s3.GetObjectOutput, error) {
+	if p.Replica == nil || p.Replica.Timeout <= 0 {
+		return p.getFromSources(ctx, key, headers)
+	}
+
+	// Only waiting for the answer is limited, not reading the body after
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(time.Duration(p.Replica.Timeout), cancel)
+	obj, err := p.getFromSources(ctx, key, headers)
+	timer.Stop()
+	return obj, err
+}
+
+// getWithFailover gets key from the primary, or from the replica if the primary
+// fails with a 5xx, is too slow or its circuit breaker is open.
+func (p S3Proxy) getWithFailover(ctx aws.Context, w http.ResponseWriter, key string, headers http.Header) (*s3.GetObjectOutput, error) {
+	var obj *s3.GetObjectOutput
+	var err error
+	switch {
+	case p.circuitOpen && p.Replica == nil:
+		return nil, p.circuitOpenError(w)
+	case p.circuitOpen:
+		err = errors.New("circuit breaker open")
+	default:
+		obj, err = p.getFromPrimary(ctx, key, headers)
+	}
+	if p.Replica == nil || ctx.Err() != nil {
+		// A request that went away is not a reason to ask the replica
+		return obj, err
+	}
+	if !shouldFailover(err) {
+		w.Header().Set(replicaHeader, "primary")
+		return obj, err
+	}
+
+	p.log.Warn("primary failed, reading from replica",
+		zap.String("bucket", p.Bucket),
+		zap.String("replica_bucket", p.Replica.Bucket),
+		zap.String("key", key),
+		zap.String("err", err.Error()),
+	)
+
+	replica := p
+	replica.Bucket = p.Replica.Bucket
+	replica.client = p.replicaClient
+	replica.Overlays = nil
+	obj, err = replica.getS3Object(ctx, replica.Bucket, key, headers)
+	if shouldFailover(err) {
+		p.log.Error("replica failed too",
+			zap.String("replica_bucket", replica.Bucket),
+			zap.String("key", key),
+			zap.String("err", err.Error()),
+		)
+		return obj, err
+	}
+
+	// The replica answered, even if it is with a 404 or a 304
+	w.Header().Set(replicaHeader, "secondary")
+	p.log.Info("served from replica",
+		zap.String("replica_bucket", replica.Bucket),
+		zap.String("key", key),
+	)
+	return obj, err
+}
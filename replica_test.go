@@ -0,0 +1,110 @@
+package caddys3proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestReplicaFailover(t *testing.T) {
+	client := newS3Client(t)
+	bucketName := setupTestBucket(t, client)
+
+	slow, slowClient := newStubS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+		w.WriteHeader(http.StatusOK)
+	})
+	defer slow.Close()
+
+	broken, brokenClient := newStubS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer broken.Close()
+
+	type testCase struct {
+		name            string
+		primary         *s3.S3
+		expectedReplica string
+	}
+
+	testCases := []testCase{
+		{name: "primary ok", primary: client, expectedReplica: "primary"},
+		{name: "primary 5xx", primary: brokenClient, expectedReplica: "secondary"},
+		{name: "primary too slow", primary: slowClient, expectedReplica: "secondary"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := S3Proxy{
+				Bucket: bucketName,
+				Replica: &ReplicaConfig{
+					Bucket:  bucketName,
+					Timeout: caddy.Duration(200 * time.Millisecond),
+				},
+				client:        tc.primary,
+				replicaClient: client,
+				log:           zap.NewExample(),
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/test.json", nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			resp := httptest.NewRecorder()
+			_ = proxy.ServeHTTP(resp, req, nil)
+
+			if resp.Code != http.StatusOK {
+				t.Fatalf("Expected code %d, got %d", http.StatusOK, resp.Code)
+			}
+			if got := resp.Header().Get(replicaHeader); got != tc.expectedReplica {
+				t.Errorf("Expected to be served by %s, got %s", tc.expectedReplica, got)
+			}
+		})
+	}
+}
+
+func TestReplicaRequestCanceled(t *testing.T) {
+	var replicaRequests int32
+	slow, slowClient := newStubS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	defer slow.Close()
+	replica, replicaClient := newStubS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&replicaRequests, 1)
+	})
+	defer replica.Close()
+
+	proxy := S3Proxy{
+		Bucket: "mybucket",
+		Replica: &ReplicaConfig{
+			Bucket:  "myreplica",
+			Timeout: caddy.Duration(500 * time.Millisecond),
+		},
+		client:        slowClient,
+		replicaClient: replicaClient,
+		log:           zap.NewNop(),
+	}
+
+	// The primary is given up on as soon as the request is gone, and the replica is not asked
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := proxy.getWithFailover(ctx, httptest.NewRecorder(), "/test.json", http.Header{})
+	if err == nil {
+		t.Fatal("Expected the canceled request to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("Expected the primary to be given up on with the request, took %v", elapsed)
+	}
+	if n := atomic.LoadInt32(&replicaRequests); n != 0 {
+		t.Errorf("Expected no replica requests, got %d", n)
+	}
+}
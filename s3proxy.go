@@ -2,12 +2,14 @@ package caddys3proxy
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"path"
 	"path/filepath"
 	"reflect"
@@ -16,7 +18,6 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	caddy "github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
@@ -41,12 +42,31 @@ type S3Proxy struct {
 	// The AWS profile to use if mulitple profiles are specified in creds
 	Profile string `json:"profile,omitempty"`
 
+	// Where the credentials come from, instead of the default chain of the SDK
+	Credentials *CredentialsConfig `json:"credentials,omitempty"`
+
+	// Tunes the HTTP transport used to talk to S3
+	Transport *TransportConfig `json:"transport,omitempty"`
+
 	// The name of the S3 bucket
 	Bucket string `json:"bucket,omitempty"`
 
 	// Use non-standard endpoint for S3
 	Endpoint string `json:"endpoint,omitempty"`
 
+	// Several S3-compatible endpoints (like the nodes of a MinIO cluster) to spread requests over,
+	// instead of Endpoint
+	Endpoints []string `json:"endpoints,omitempty"`
+
+	// How an endpoint is picked for a request: round_robin (default), least_latency or random
+	EndpointPolicy string `json:"endpoint_policy,omitempty"`
+
+	// Failed requests in a row after which an endpoint is left out. Default is 1.
+	EndpointMaxFails int `json:"endpoint_max_fails,omitempty"`
+
+	// How long a failing endpoint is left out for. Default is 30s.
+	EndpointCooldown caddy.Duration `json:"endpoint_cooldown,omitempty"`
+
 	// The names of files to try as index files if a folder is requested.
 	IndexNames []string `json:"index_names,omitempty"`
 
@@ -59,6 +79,98 @@ type S3Proxy struct {
 	// Flag to determine if DELETE operations are allowed (default false)
 	EnableDelete bool
 
+	// Flag to allow multipart/form-data POST uploads to "directories" (default false)
+	EnableFormUpload bool `json:"enable_form_upload,omitempty"`
+
+	// Flag to enable resumable uploads with the tus protocol (default false)
+	EnableTus bool `json:"enable_tus,omitempty"`
+
+	// Key prefix where the state of tus uploads is kept. Default is "/.tus/".
+	// Keys under this prefix are hidden.
+	TusStatePrefix string `json:"tus_state_prefix,omitempty"`
+
+	// Flag to allow deploying .tar.gz, .tar or .zip archives by POSTing them to a "directory" (default false)
+	EnableDeploy bool `json:"enable_deploy,omitempty"`
+
+	// Number of parallel uploads used by a deploy. Default is 8.
+	DeployConcurrency int `json:"deploy_concurrency,omitempty"`
+
+	// Largest archive a deploy accepts, in bytes. Default is 1GiB.
+	DeployMaxSize int64 `json:"deploy_max_size,omitempty"`
+
+	// Largest total size of the files extracted by a deploy, in bytes. Default is 4GiB.
+	DeployMaxExtract int64 `json:"deploy_max_extract,omitempty"`
+
+	// Flag to allow comparing a manifest of files with a prefix by POSTing it to "<prefix>/?sync" (default false)
+	EnableSync bool `json:"enable_sync,omitempty"`
+
+	// Flag to store PUTs to a "directory" under a key made from the SHA-256 of the body (default false)
+	EnableContentAddressed bool `json:"enable_content_addressed,omitempty"`
+
+	// Key template (relative to the "directory") of content-addressed PUTs.
+	// Default is "cas/sha256/${sha256:2}/${sha256}".
+	ContentAddressedKey string `json:"content_addressed_key,omitempty"`
+
+	// Buckets and prefixes looked in, in order, when a GET is for a key that is not in Bucket.
+	// Browse listings merge all of them.
+	Overlays []OverlaySource `json:"overlays,omitempty"`
+
+	// A secondary bucket GETs fail over to when this one fails or is too slow
+	Replica *ReplicaConfig `json:"replica,omitempty"`
+
+	// Remember keys that don't exist for a short time
+	NotFoundCache *NotFoundCacheConfig `json:"not_found_cache,omitempty"`
+
+	// Keep chunks of objects in memory to serve Range requests from
+	ChunkCache *ChunkCacheConfig `json:"chunk_cache,omitempty"`
+
+	// Fetch large objects as several byte ranges at once
+	ParallelGet *ParallelGetConfig `json:"parallel_get,omitempty"`
+
+	// Send a second GetObject when the first is slow to answer
+	Hedge *HedgeConfig `json:"hedge,omitempty"`
+
+	// Fail fast while S3 is failing or slow
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+
+	// The request path of an endpoint reporting if the bucket can be reached. Empty disables it.
+	HealthPath string `json:"health_path,omitempty"`
+
+	// Key the health endpoint runs a HeadObject on. If empty a HeadBucket is done instead.
+	HealthCanary string `json:"health_canary,omitempty"`
+
+	// How long the result of a health probe is reused for. Default is 10s.
+	HealthInterval caddy.Duration `json:"health_interval,omitempty"`
+
+	// Check the bucket can be reached when the config is loaded, so a bad config fails to load (default false)
+	StartupProbe bool `json:"startup_probe,omitempty"`
+
+	// Also check the bucket can be listed when the config is loaded (default false)
+	StartupProbeList bool `json:"startup_probe_list,omitempty"`
+
+	// Base URL of an HTTP origin that keys missing from S3 are fetched from.
+	// Fetched objects are written to the bucket while being served.
+	Origin string `json:"origin,omitempty"`
+
+	// How long fetching an object from the origin may take, body included. Default is 1m.
+	OriginTimeout caddy.Duration `json:"origin_timeout,omitempty"`
+
+	// Configures an endpoint that issues presigned upload URLs
+	Presign *PresignConfig `json:"presign,omitempty"`
+
+	// Require GET requests to carry a valid signed share link
+	SignedURLs *SignedURLConfig `json:"signed_urls,omitempty"`
+
+	// Map request hosts to key prefixes (added after root)
+	HostPrefixes *HostPrefixConfig `json:"host_prefixes,omitempty"`
+
+	// Key of a pointer object holding the prefix of the active release.
+	// The prefix is prepended to the key of GET requests.
+	ReleasePointer string `json:"release_pointer,omitempty"`
+
+	// How long the release pointer is cached for. Default is 10s.
+	ReleasePointerTTL caddy.Duration `json:"release_pointer_ttl,omitempty"`
+
 	// Flag to enable browsing of "directories" in S3 (paths that end with a /)
 	EnableBrowse bool
 
@@ -77,9 +189,23 @@ type S3Proxy struct {
 	// Set this to `true` to enable S3 Accelerate feature.
 	S3UseAccelerate bool `json:"use_accelerate,omitempty"`
 
-	client      *s3.S3
-	dirTemplate *template.Template
-	log         *zap.Logger
+	client        *s3.S3
+	replicaClient *s3.S3
+	sessionKey    string
+	clients       *clientCache
+	endpoints     *endpointPool
+	regions       *regionCache
+	hedges        *hedger
+	chunks        *chunkCache
+	notFound      *notFoundCache
+	breakers      *breakerSet
+	health        *healthCache
+	releases      *releaseCache
+	dirTemplate   *template.Template
+	log           *zap.Logger
+
+	// Set on the copy of a request if the breaker of its bucket is open
+	circuitOpen bool
 }
 
 // CaddyModule returns the Caddy module information.
@@ -105,6 +231,70 @@ func (p *S3Proxy) Provision(ctx caddy.Context) (err error) {
 		p.ErrorPages = make(map[int]string)
 	}
 
+	if p.EnableTus {
+		if p.TusStatePrefix == "" {
+			p.TusStatePrefix = defaultTusStatePrefix
+		}
+		// Never serve the upload state
+		p.Hide = append(p.Hide, path.Join("/", p.TusStatePrefix))
+	}
+
+	if p.EnableContentAddressed {
+		if _, err := contentAddressedKey(p.ContentAddressedKey, sha256Hex(nil)); err != nil {
+			return fmt.Errorf("invalid content addressed key: %v", err)
+		}
+	}
+
+	if p.Replica != nil && p.Replica.Bucket == "" {
+		return errors.New("replica bucket must be set")
+	}
+
+	if p.Origin != "" {
+		u, err := url.Parse(p.Origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("origin '%s' is not an http or https URL", p.Origin)
+		}
+	}
+
+	if p.Presign != nil {
+		if p.Presign.Path == "" {
+			return errors.New("presign path must be set")
+		}
+		if p.Presign.expiry() > maxPresignExpiry {
+			return fmt.Errorf("presign expiry can not be more than %v", maxPresignExpiry)
+		}
+		for i, prefix := range p.Presign.AllowPrefixes {
+			p.Presign.AllowPrefixes[i] = normalizePresignPrefix(prefix)
+		}
+	}
+
+	if p.SignedURLs != nil {
+		if len(p.SignedURLs.Keys) == 0 {
+			return errors.New("signed_urls needs at least one key")
+		}
+		if p.SignedURLs.StatePrefix == "" {
+			p.SignedURLs.StatePrefix = defaultSignedURLStatePrefix
+		}
+		// Never serve the download counts
+		p.Hide = append(p.Hide, path.Join("/", p.SignedURLs.StatePrefix))
+	}
+
+	if p.ReleasePointer != "" {
+		ttl := time.Duration(p.ReleasePointerTTL)
+		if ttl <= 0 {
+			ttl = defaultReleasePointerTTL
+		}
+		p.releases = newReleaseCache(ttl)
+	}
+
+	if p.HealthPath != "" {
+		interval := time.Duration(p.HealthInterval)
+		if interval <= 0 {
+			interval = defaultHealthInterval
+		}
+		p.health = newHealthCache(interval)
+	}
+
 	if p.EnableBrowse {
 		var tpl *template.Template
 		var err error
@@ -123,46 +313,82 @@ func (p *S3Proxy) Provision(ctx caddy.Context) (err error) {
 		p.dirTemplate = tpl
 	}
 
-	var config aws.Config
+	// Placeholders in these can only be resolved per request
+	dynamic := hasPlaceholder(p.Bucket) || hasPlaceholder(p.Region) || hasPlaceholder(p.Endpoint)
 
-	// If Region is not specified NewSession will look for it from an env value AWS_REGION
-	if p.Region != "" {
-		config.Region = aws.String(p.Region)
+	shared, err := p.loadSession()
+	if err != nil {
+		return err
 	}
+	sess := shared.sess
+	p.client = shared.client
 
-	if p.Endpoint != "" {
-		config.Endpoint = aws.String(p.Endpoint)
+	if p.CircuitBreaker != nil {
+		// Clients copy the handlers of the session, so every S3 request gets counted.
+		// The handlers are added to a copy to keep them out of the shared session.
+		p.breakers = newBreakerSet(*p.CircuitBreaker, p.log)
+		sess = sess.Copy()
+		sess.Handlers.Complete.PushBack(p.breakers.recordRequest)
+		p.client = s3.New(sess)
 	}
 
-	if p.S3ForcePathStyle {
-		config.S3ForcePathStyle = aws.Bool(p.S3ForcePathStyle)
+	if dynamic {
+		p.clients = newClientCache(sess)
 	}
-
-	if p.S3UseAccelerate {
-		config.S3UseAccelerate = aws.Bool(p.S3UseAccelerate)
+	if p.Hedge != nil {
+		p.hedges = newHedger(*p.Hedge)
 	}
-
-	sess, err := session.NewSessionWithOptions(session.Options{
-		Profile:           p.Profile,
-		Config:            config,
-		SharedConfigState: session.SharedConfigEnable,
-	})
-	if err != nil {
-		p.log.Error("could not create AWS session",
-			zap.String("error", err.Error()),
-		)
-		return err
+	if p.ChunkCache != nil {
+		p.chunks = newChunkCache(*p.ChunkCache)
+	}
+	if p.NotFoundCache != nil {
+		p.notFound = newNotFoundCache(*p.NotFoundCache)
+	}
+	if len(p.Endpoints) > 0 {
+		p.endpoints = newEndpointPool(sess, p.Endpoints, p.EndpointPolicy, p.EndpointMaxFails,
+			time.Duration(p.EndpointCooldown), p.log)
+	} else {
+		// The nodes of an endpoint pool are not AWS, so they don't redirect to other regions
+		p.regions = newRegionCache(sess)
+	}
+	if p.Replica != nil {
+		var replicaConfig aws.Config
+		if p.Replica.Region != "" {
+			replicaConfig.Region = aws.String(p.Replica.Region)
+		}
+		if p.Replica.Endpoint != "" {
+			replicaConfig.Endpoint = aws.String(p.Replica.Endpoint)
+		}
+		p.replicaClient = s3.New(sess, &replicaConfig)
 	}
-
-	// Create S3 service client
-	p.client = s3.New(sess)
 	p.log.Info("S3 proxy initialized for bucket: " + p.Bucket)
 	p.log.Debug("config values",
 		zap.String("endpoint", p.Endpoint),
+		zap.Strings("endpoints", p.Endpoints),
 		zap.String("region", p.Region),
 		zap.String("profile", p.Profile),
+		zap.String("credentials", p.Credentials.source()),
 		zap.Bool("enable_put", p.EnablePut),
 		zap.Bool("enable_delete", p.EnableDelete),
+		zap.Bool("enable_form_upload", p.EnableFormUpload),
+		zap.Bool("enable_tus", p.EnableTus),
+		zap.Bool("enable_deploy", p.EnableDeploy),
+		zap.Bool("enable_sync", p.EnableSync),
+		zap.Bool("enable_content_addressed", p.EnableContentAddressed),
+		zap.Int("overlays", len(p.Overlays)),
+		zap.Bool("replica", p.Replica != nil),
+		zap.String("origin", p.Origin),
+		zap.Bool("circuit_breaker", p.CircuitBreaker != nil),
+		zap.Bool("hedge", p.Hedge != nil),
+		zap.Bool("parallel_get", p.ParallelGet != nil),
+		zap.Bool("chunk_cache", p.ChunkCache != nil),
+		zap.Bool("not_found_cache", p.NotFoundCache != nil),
+		zap.String("health_path", p.HealthPath),
+		zap.Bool("startup_probe", p.StartupProbe),
+		zap.Bool("presign", p.Presign != nil),
+		zap.Bool("signed_urls", p.SignedURLs != nil),
+		zap.Bool("host_prefixes", p.HostPrefixes != nil),
+		zap.String("release_pointer", p.ReleasePointer),
 		zap.String("default_error_page", p.DefaultErrorPage),
 		zap.Bool("enable_browse", p.EnableBrowse),
 		zap.Bool("force_path_style", p.S3ForcePathStyle),
@@ -172,7 +398,7 @@ func (p *S3Proxy) Provision(ctx caddy.Context) (err error) {
 	return nil
 }
 
-func (p S3Proxy) getS3Object(bucket string, path string, headers http.Header) (*s3.GetObjectOutput, error) {
+func (p S3Proxy) getS3Object(ctx aws.Context, bucket string, path string, headers http.Header) (*s3.GetObjectOutput, error) {
 	oi := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(path),
@@ -205,9 +431,28 @@ func (p S3Proxy) getS3Object(bucket string, path string, headers http.Header) (*
 		zap.String("key", path),
 	)
 
+	if p.chunks != nil && headers.Get("Range") != "" {
+		if start, end, ok := parseByteRange(headers.Get("Range")); ok {
+			return p.chunkedGetObject(ctx, oi, start, end)
+		}
+	}
+	if p.ParallelGet != nil {
+		if start, _, ok := parseByteRange(headers.Get("Range")); ok {
+			return p.parallelGetObject(ctx, oi, start)
+		}
+	}
+	return p.sendGetObject(ctx, oi)
+}
+
+// sendGetObject sends one GetObject request, hedged if that is turned on
+func (p S3Proxy) sendGetObject(ctx aws.Context, oi *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if p.hedges != nil {
+		return p.hedgedGetObject(ctx, oi)
+	}
+
 	// TODO: GetObject could return the aws error InternalError, if that happens it is best practice to retry the
 	// the call.  That retry logic should go here...
-	return p.client.GetObject(oi)
+	return p.client.GetObjectWithContext(ctx, oi)
 }
 
 func joinPath(root string, uriPath string) string {
@@ -229,8 +474,15 @@ func makeAwsString(str string) *string {
 }
 
 func (p S3Proxy) PutHandler(w http.ResponseWriter, r *http.Request, key string) error {
+	if !p.EnablePut {
+		err := errors.New("method not allowed")
+		return caddyhttp.Error(http.StatusMethodNotAllowed, err)
+	}
 	isDir := strings.HasSuffix(key, "/")
-	if isDir || !p.EnablePut {
+	if isDir && p.EnableContentAddressed {
+		return p.ContentAddressedPutHandler(w, r, key)
+	}
+	if isDir {
 		err := errors.New("method not allowed")
 		return caddyhttp.Error(http.StatusMethodNotAllowed, err)
 	}
@@ -253,10 +505,15 @@ func (p S3Proxy) PutHandler(w http.ResponseWriter, r *http.Request, key string)
 		ContentType:        makeAwsString(r.Header.Get("Content-Type")),
 		Body:               bytes.NewReader(buf),
 	}
+	if p.EnableSync {
+		// Keep the checksum so a later sync can tell if the file changed
+		oi.Metadata = map[string]*string{sha256MetadataKey: aws.String(sha256Hex(buf))}
+	}
 	po, err := p.client.PutObject(&oi)
 	if err != nil {
 		return convertToCaddyError(err)
 	}
+	p.forgetNotFound(key)
 
 	setStrHeader(w, "ETag", po.ETag)
 
@@ -284,9 +541,14 @@ func (p S3Proxy) DeleteHandler(w http.ResponseWriter, r *http.Request, key strin
 
 func (p S3Proxy) BrowseHandler(w http.ResponseWriter, r *http.Request, key string) error {
 
-	input := p.ConstructListObjInput(r, key)
-
-	result, err := p.client.ListObjectsV2(&input)
+	var result *s3.ListObjectsV2Output
+	var err error
+	if len(p.Overlays) > 0 {
+		result, err = p.listSources(r, key)
+	} else {
+		input := p.ConstructListObjInput(r, key)
+		result, err = p.client.ListObjectsV2(&input)
+	}
 	if err != nil {
 		p.log.Debug("error in ListObjectsV2",
 			zap.String("bucket", p.Bucket),
@@ -339,7 +601,7 @@ func (p S3Proxy) writeResponseFromGetObject(w http.ResponseWriter, obj *s3.GetOb
 }
 
 func (p S3Proxy) serveErrorPage(w http.ResponseWriter, s3Key string) error {
-	obj, err := p.getS3Object(p.Bucket, s3Key, nil)
+	obj, err := p.getS3Object(aws.BackgroundContext(), p.Bucket, s3Key, nil)
 	if err != nil {
 		return err
 	}
@@ -355,19 +617,64 @@ func (p S3Proxy) serveErrorPage(w http.ResponseWriter, s3Key string) error {
 func (p S3Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 
-	fullPath := joinPath(repl.ReplaceAll(p.Root, ""), r.URL.Path)
+	root, err := p.requestRoot(r, repl)
+	fullPath := joinPath(root, r.URL.Path)
 
-	var err error
-	switch r.Method {
-	case http.MethodGet:
-		err = p.GetHandler(w, r, fullPath)
-	case http.MethodPut:
+	// Since p is a copy, the resolved bucket and client only apply to this request
+	if err == nil {
+		err = p.resolveForRequest(repl)
+	}
+	if err == nil && p.endpoints != nil {
+		p.client = p.endpoints.pick().client
+	}
+	if err == nil {
+		p.useDiscoveredRegion()
+	}
+	if err == nil && p.breakers != nil {
+		p.circuitOpen = !p.breakers.allow(p.Bucket)
+	}
+	switch {
+	case p.HealthPath != "" && r.URL.Path == p.HealthPath:
+		err = p.HealthHandler(w, r)
+	case err != nil:
+		// Could not work out where to send the request
+	case p.Presign != nil && r.URL.Path == p.Presign.Path:
+		err = p.PresignHandler(w, r, root)
+	case r.Method != http.MethodGet && p.isStateKey(fullPath):
+		err = caddyhttp.Error(http.StatusForbidden, errors.New("key is reserved for proxy state"))
+	case p.circuitOpen && r.Method != http.MethodGet:
+		// GETs may still be served by the replica or from the stale cache
+		err = p.circuitOpenError(w)
+	case p.EnableTus && isTusRequest(r):
+		err = p.TusHandler(w, r, fullPath)
+	case p.SignedURLs != nil && p.SignedURLs.IssuePath != "" && originalURL(r).Path == p.SignedURLs.IssuePath:
+		err = p.IssueSignedURLHandler(w, r)
+	case r.Method == http.MethodGet:
+		var download *signedDownload
+		if p.SignedURLs != nil {
+			download, err = p.checkSignedURL(r)
+		}
+		if err == nil && p.ReleasePointer != "" {
+			fullPath, err = p.releasePath(repl, fullPath)
+		}
+		if err == nil {
+			err = p.GetHandler(w, r, fullPath)
+		}
+		if err == nil && download != nil {
+			p.countDownload(r, download)
+		}
+	case r.Method == http.MethodPut:
 		err = p.PutHandler(w, r, fullPath)
-	case http.MethodDelete:
+	case r.Method == http.MethodPost:
+		err = p.PostHandler(w, r, fullPath)
+	case r.Method == http.MethodDelete:
 		err = p.DeleteHandler(w, r, fullPath)
 	default:
 		err = caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("method not allowed"))
 	}
+	if err != nil && p.regions != nil && isRegionError(err) {
+		err = p.retryInBucketRegion(w, r, fullPath, err)
+	}
 	if err == nil {
 		// Success!
 		return nil
@@ -445,7 +752,7 @@ func (p S3Proxy) GetHandler(w http.ResponseWriter, r *http.Request, fullPath str
 	if isDir && len(p.IndexNames) > 0 {
 		for _, indexPage := range p.IndexNames {
 			indexPath := path.Join(fullPath, indexPage)
-			obj, err = p.getS3Object(p.Bucket, indexPath, r.Header)
+			obj, err = p.getObject(r.Context(), w, indexPath, r.Header)
 			caddyErr := convertToCaddyError(err)
 			if err == nil || caddyErr.StatusCode == 304 {
 				// We found an index!
@@ -471,8 +778,11 @@ func (p S3Proxy) GetHandler(w http.ResponseWriter, r *http.Request, fullPath str
 		}
 	}
 
-	// If this is still a dir then browse or throw an error
-	if isDir {
+	// If this is still a dir then browse or throw an error (unless S3 is failing)
+	if isDir && p.circuitOpen && !shouldFailover(err) {
+		err = p.circuitOpenError(w)
+	}
+	if isDir && !shouldFailover(err) {
 		if p.EnableBrowse {
 			return p.BrowseHandler(w, r, fullPath)
 		} else {
@@ -482,11 +792,19 @@ func (p S3Proxy) GetHandler(w http.ResponseWriter, r *http.Request, fullPath str
 	}
 
 	// Get the obj from S3 (skip if we already did when looking for an index)
-	if obj == nil {
-		obj, err = p.getS3Object(p.Bucket, fullPath, r.Header)
+	if obj == nil && !isDir {
+		obj, err = p.getObject(r.Context(), w, fullPath, r.Header)
 	}
 	if err != nil {
 		caddyErr := convertToCaddyError(err)
+		if caddyErr.StatusCode == http.StatusNotFound && p.Origin != "" {
+			return p.PullThroughHandler(w, r, fullPath)
+		}
+		if caddyErr.StatusCode >= http.StatusInternalServerError {
+			if served, err := p.serveStale(w, fullPath, caddyErr); served {
+				return err
+			}
+		}
 		if caddyErr.StatusCode == http.StatusNotFound {
 			// Log as debug as this one may be quite common
 			p.log.Debug("not found",
@@ -505,6 +823,9 @@ func (p S3Proxy) GetHandler(w http.ResponseWriter, r *http.Request, fullPath str
 		return caddyErr
 	}
 
+	if obj, err = p.keepStale(r, fullPath, obj); err != nil {
+		return convertToCaddyError(err)
+	}
 	return p.writeResponseFromGetObject(w, obj)
 }
 
@@ -520,6 +841,48 @@ func setTimeHeader(w http.ResponseWriter, key string, value *time.Time) {
 	}
 }
 
+// bearerAuthorized returns true if the request has one of the bearer tokens.
+// An empty token list authorizes nobody.
+func bearerAuthorized(r *http.Request, tokens []string) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// originalURL returns the URL the client asked for, before any rewrite of the request.
+func originalURL(r *http.Request) url.URL {
+	if orig, ok := r.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request); ok {
+		return *orig.URL
+	}
+	return *r.URL
+}
+
+// isStateKey returns true if key is under a prefix where the proxy keeps its own state.
+// Clients can only read those keys through the proxy's handlers, never write or delete them.
+func (p S3Proxy) isStateKey(key string) bool {
+	if p.EnableTus && underPrefix(key, p.TusStatePrefix) {
+		return true
+	}
+	return p.SignedURLs != nil && underPrefix(key, p.SignedURLs.StatePrefix)
+}
+
+// underPrefix returns true if key is prefix or is in the "directory" prefix
+func underPrefix(key string, prefix string) bool {
+	if prefix == "" {
+		return false
+	}
+	prefix = path.Join("/", prefix)
+	return key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
 // fileHidden returns true if filename is hidden
 // according to the hide list.
 func fileHidden(filename string, hide []string) bool {
@@ -7,6 +7,7 @@ import (
 	"io"
 	"math/rand"
 	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -22,6 +23,7 @@ import (
 	caddy "github.com/caddyserver/caddy/v2"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
@@ -178,6 +180,33 @@ func newS3Client(t *testing.T) *s3.S3 {
 	return s3.New(sess)
 }
 
+// newStubSession returns a session for talking to stub S3 servers, with static credentials and
+// no retries. An empty endpoint leaves the endpoint to the clients made from it.
+func newStubSession(t *testing.T, endpoint string) *session.Session {
+	config := aws.Config{
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	}
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+
+	sess, err := session.NewSession(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+// newStubS3Client starts a stub S3 server answering with handler and returns it with a client
+// sending its requests there. The caller closes the server.
+func newStubS3Client(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *s3.S3) {
+	stub := httptest.NewServer(handler)
+	return stub, s3.New(newStubSession(t, stub.URL))
+}
+
 func setupTestBucket(t *testing.T, client *s3.S3) string {
 	bucketName := fmt.Sprintf(
 		"caddy-s3-proxy-testdata-%d-%d",
@@ -236,9 +265,34 @@ func setupTestBucket(t *testing.T, client *s3.S3) string {
 	return bucketName
 }
 
+func makeFormBody(t *testing.T, fields map[string]string, filename string, content string) ([]byte, string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), mw.FormDataContentType()
+}
+
 func TestProxy(t *testing.T) {
 	client := newS3Client(t)
 	bucketName := setupTestBucket(t, client)
+	formBody, formContentType := makeFormBody(t, map[string]string{
+		"key":                   "${filename}",
+		"success_action_status": "201",
+	}, "uploaded.txt", "form content")
 
 	for _, tc := range []struct {
 		name                 string
@@ -312,6 +366,26 @@ func TestProxy(t *testing.T) {
 			expectedCode:         http.StatusOK,
 			expectsEmptyResponse: true,
 		},
+		{
+			name:                 "can't form upload if not allowed",
+			proxy:                S3Proxy{Bucket: bucketName},
+			method:               http.MethodPost,
+			path:                 "/uploads/",
+			expectedCode:         http.StatusMethodNotAllowed,
+			expectsEmptyResponse: true,
+		},
+		{
+			name:    "can form upload if allowed",
+			proxy:   S3Proxy{Bucket: bucketName, EnableFormUpload: true},
+			method:  http.MethodPost,
+			path:    "/uploads/",
+			body:    formBody,
+			headers: http.Header{"Content-Type": []string{formContentType}},
+			expectedHeaders: http.Header{
+				"Content-Type": []string{"application/json; charset=utf-8"},
+			},
+			expectedCode: http.StatusCreated,
+		},
 		{
 			name:                 "serves index.html",
 			proxy:                S3Proxy{Bucket: bucketName, IndexNames: []string{"index.html"}},
@@ -0,0 +1,185 @@
+package caddys3proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// sessions holds the AWS sessions of all handlers, shared by those with the same config.
+// Entries outlive a config reload as long as the new config still uses them.
+var sessions = caddy.NewUsagePool()
+
+// sessionKey is everything that makes two sessions different
+type sessionKey struct {
+	Region         string             `json:"region,omitempty"`
+	Endpoint       string             `json:"endpoint,omitempty"`
+	Profile        string             `json:"profile,omitempty"`
+	ForcePathStyle bool               `json:"force_path_style,omitempty"`
+	UseAccelerate  bool               `json:"use_accelerate,omitempty"`
+	Credentials    *CredentialsConfig `json:"credentials,omitempty"`
+	Transport      *TransportConfig   `json:"transport,omitempty"`
+
+	// Hash of the static keys after placeholders are replaced, so a changed
+	// secret file gets a new session on reload
+	ResolvedKeys string `json:"resolved_keys,omitempty"`
+
+	// Hash of the CA files, so a renewed CA gets a new session on reload too
+	ResolvedCAs string `json:"resolved_cas,omitempty"`
+}
+
+// sharedSession is a session, its connection pool and a client using it
+type sharedSession struct {
+	sess      *session.Session
+	client    *s3.S3
+	transport *http.Transport
+}
+
+// Destruct closes the idle connections once no handler uses the session any more
+func (s *sharedSession) Destruct() error {
+	s.transport.CloseIdleConnections()
+	return nil
+}
+
+// sessionConfig returns the config of the session of the handler and the key it is shared under
+func (p S3Proxy) sessionConfig() (aws.Config, string, error) {
+	var config aws.Config
+	key := sessionKey{
+		Profile:        p.Profile,
+		ForcePathStyle: p.S3ForcePathStyle,
+		UseAccelerate:  p.S3UseAccelerate,
+		Credentials:    p.Credentials,
+		Transport:      p.Transport,
+	}
+
+	// If Region is not specified NewSession will look for it from an env value AWS_REGION
+	if p.Region != "" && !hasPlaceholder(p.Region) {
+		config.Region = aws.String(p.Region)
+		key.Region = p.Region
+	}
+
+	if p.Endpoint != "" && !hasPlaceholder(p.Endpoint) {
+		config.Endpoint = aws.String(p.Endpoint)
+		key.Endpoint = p.Endpoint
+	}
+
+	// The clients of an endpoint pool set their own endpoint, the first one is the default of
+	// the session (and the replica)
+	if len(p.Endpoints) > 0 {
+		config.Endpoint = aws.String(p.Endpoints[0])
+		key.Endpoint = p.Endpoints[0]
+	}
+
+	if p.S3ForcePathStyle {
+		config.S3ForcePathStyle = aws.Bool(p.S3ForcePathStyle)
+	}
+
+	if p.S3UseAccelerate {
+		config.S3UseAccelerate = aws.Bool(p.S3UseAccelerate)
+	}
+
+	p.Transport.applyEndpointOptions(&config)
+
+	if p.Transport != nil && len(p.Transport.TLSCAFiles) > 0 {
+		var cas []byte
+		for _, file := range p.Transport.TLSCAFiles {
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return config, "", fmt.Errorf("transport: reading CA file: %v", err)
+			}
+			cas = append(cas, pem...)
+		}
+		key.ResolvedCAs = sha256Hex(cas)
+	}
+
+	if p.Credentials != nil {
+		// nil leaves the default chain (or the profile) in place
+		creds, err := p.Credentials.baseCredentials()
+		if err != nil {
+			return config, "", fmt.Errorf("credentials: %v", err)
+		}
+		if creds != nil && !p.Credentials.Anonymous {
+			value, err := creds.Get()
+			if err != nil {
+				return config, "", fmt.Errorf("credentials: %v", err)
+			}
+			key.ResolvedKeys = sha256Hex([]byte(value.AccessKeyID + "\n" + value.SecretAccessKey + "\n" + value.SessionToken))
+		}
+		config.Credentials = creds
+	}
+
+	encoded, err := json.Marshal(key)
+	if err != nil {
+		return config, "", err
+	}
+	return config, sha256Hex(encoded), nil
+}
+
+// loadSession returns the shared session for the config of the handler, creating it if no other
+// handler uses it yet. Every call must be matched by a sessions.Delete of the key, done in Cleanup.
+func (p *S3Proxy) loadSession() (*sharedSession, error) {
+	config, key, err := p.sessionConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	value, loaded, err := sessions.LoadOrNew(key, func() (caddy.Destructor, error) {
+		transport, err := p.Transport.newTransport()
+		if err != nil {
+			return nil, fmt.Errorf("transport: %v", err)
+		}
+		config.HTTPClient = &http.Client{Transport: transport}
+
+		sess, err := session.NewSessionWithOptions(session.Options{
+			Profile:           p.Profile,
+			Config:            config,
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if p.Credentials != nil && p.Credentials.RoleARN != "" {
+			sess, err = p.Credentials.assumeRole(sess, p.log)
+			if err != nil {
+				return nil, fmt.Errorf("credentials: %v", err)
+			}
+		}
+
+		return &sharedSession{
+			sess:      sess,
+			client:    s3.New(sess),
+			transport: transport,
+		}, nil
+	})
+	if err != nil {
+		p.log.Error("could not create AWS session",
+			zap.String("error", err.Error()),
+		)
+		return nil, err
+	}
+
+	p.sessionKey = key
+	p.log.Debug("AWS session",
+		zap.String("key", key),
+		zap.Bool("shared", loaded),
+	)
+	return value.(*sharedSession), nil
+}
+
+// Cleanup releases the session of the handler, it is closed when no handler uses it any more.
+func (p *S3Proxy) Cleanup() error {
+	if p.sessionKey == "" {
+		return nil
+	}
+	_, err := sessions.Delete(p.sessionKey)
+	p.sessionKey = ""
+	return err
+}
@@ -0,0 +1,115 @@
+package caddys3proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSharedSessions(t *testing.T) {
+	newProxy := func(bucket string, region string) *S3Proxy {
+		return &S3Proxy{
+			Bucket: bucket,
+			Region: region,
+			Credentials: &CredentialsConfig{
+				AccessKeyID:     "id",
+				SecretAccessKey: "secret",
+			},
+			log: zap.NewNop(),
+		}
+	}
+
+	first := newProxy("first-bucket", "us-east-1")
+	second := newProxy("second-bucket", "us-east-1")
+	other := newProxy("first-bucket", "eu-west-1")
+
+	firstSession, err := first.loadSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondSession, err := second.loadSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSession, err := other.loadSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if firstSession != secondSession {
+		t.Error("Expected handlers with the same config to share a session")
+	}
+	if firstSession == otherSession {
+		t.Error("Expected handlers in different regions to have their own session")
+	}
+	if refs, _ := sessions.References(first.sessionKey); refs != 2 {
+		t.Errorf("Expected 2 references, got %d", refs)
+	}
+
+	// A different secret is a different session too
+	rotated := newProxy("first-bucket", "us-east-1")
+	rotated.Credentials.SecretAccessKey = "rotated"
+	rotatedSession, err := rotated.loadSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotatedSession == firstSession {
+		t.Error("Expected a new session for rotated keys")
+	}
+
+	secondKey := second.sessionKey
+	for _, p := range []*S3Proxy{first, second, other, rotated} {
+		if err := p.Cleanup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := sessions.References(secondKey); ok {
+		t.Error("Expected the session to be released")
+	}
+	// Cleaning up twice does nothing
+	if err := first.Cleanup(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSessionKeyCAFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, []byte("first CA"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := S3Proxy{
+		Region:    "us-east-1",
+		Transport: &TransportConfig{TLSCAFiles: []string{caFile}},
+		log:       zap.NewNop(),
+	}
+	_, firstKey, err := p.sessionConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A renewed CA in the same file is a different session
+	if err := ioutil.WriteFile(caFile, []byte("renewed CA"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, renewedKey, err := p.sessionConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewedKey == firstKey {
+		t.Error("Expected a new session key for a renewed CA file")
+	}
+
+	os.Remove(caFile)
+	if _, _, err := p.sessionConfig(); err == nil {
+		t.Error("Expected an error for a missing CA file")
+	}
+}
@@ -0,0 +1,246 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSignedURLExpiry      = 24 * time.Hour
+	defaultSignedURLStatePrefix = "/.signed/"
+)
+
+// SigningKey is a named HMAC secret used to sign share links.
+type SigningKey struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// SignedURLConfig makes GET requests require an HMAC-signed, expiring link.
+type SignedURLConfig struct {
+	// Keys used to validate signatures. The first one is used to issue new links,
+	// the others are still accepted so keys can be rotated.
+	Keys []SigningKey `json:"keys,omitempty"`
+
+	// The request path of the endpoint that issues links. Empty disables it.
+	IssuePath string `json:"issue_path,omitempty"`
+
+	// Bearer tokens allowed to issue links. At least one is needed with an issue path.
+	AdminTokens []string `json:"admin_tokens,omitempty"`
+
+	// Longest expiry the issue endpoint will sign. Default is 24 hours.
+	MaxExpiry caddy.Duration `json:"max_expiry,omitempty"`
+
+	// Key prefix where download counts of limited links are kept. Default is "/.signed/".
+	// Keys under this prefix are hidden.
+	StatePrefix string `json:"state_prefix,omitempty"`
+}
+
+// SignedURLRequest is the JSON body POSTed to the issue endpoint.
+type SignedURLRequest struct {
+	Path         string         `json:"path"`
+	ExpiresIn    caddy.Duration `json:"expires_in"`
+	MaxDownloads int            `json:"max_downloads"`
+}
+
+// SignedURLResponse is the link handed back by the issue endpoint.
+type SignedURLResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+func (c SignedURLConfig) maxExpiry() time.Duration {
+	if c.MaxExpiry <= 0 {
+		return defaultSignedURLExpiry
+	}
+	return time.Duration(c.MaxExpiry)
+}
+
+// signURL returns the signature of a link. The download limit is signed too so it can't be removed.
+func signURL(secret string, method string, urlPath string, expires int64, limit int) string {
+	stringToSign := strings.Join([]string{
+		method,
+		urlPath,
+		strconv.FormatInt(expires, 10),
+		strconv.Itoa(limit),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256([]byte(secret), stringToSign))
+}
+
+// verifySignedURL checks the expires, limit, kid and signature query params of a request.
+// The link was signed for the URL the client asked for, so a rewrite must not change it.
+func (c SignedURLConfig) verifySignedURL(r *http.Request, now time.Time) (string, int, error) {
+	link := originalURL(r)
+	query := link.Query()
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return "", 0, errors.New("missing or invalid expires")
+	}
+	if now.Unix() > expires {
+		return "", 0, errors.New("link has expired")
+	}
+
+	limit := 0
+	if l := query.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			return "", 0, errors.New("invalid limit")
+		}
+	}
+
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil || len(signature) == 0 {
+		return "", 0, errors.New("missing or invalid signature")
+	}
+
+	kid := query.Get("kid")
+	for _, key := range c.Keys {
+		if kid != "" && key.ID != kid {
+			continue
+		}
+		expected, _ := hex.DecodeString(signURL(key.Secret, http.MethodGet, link.Path, expires, limit))
+		if hmac.Equal(signature, expected) {
+			return hex.EncodeToString(signature), limit, nil
+		}
+	}
+	return "", 0, errors.New("signature does not match")
+}
+
+// signedDownload is a GET of a link with a download limit, counted once the object is served
+type signedDownload struct {
+	countKey string
+	count    int
+}
+
+// checkSignedURL validates the share link of a GET request. If the link has a download limit
+// it checks the limit is not reached yet and returns the download to count.
+func (p S3Proxy) checkSignedURL(r *http.Request) (*signedDownload, error) {
+	signature, limit, err := p.SignedURLs.verifySignedURL(r, time.Now())
+	if err != nil {
+		p.log.Debug("rejected signed url",
+			zap.String("path", r.URL.Path),
+			zap.String("err", err.Error()),
+		)
+		return nil, caddyhttp.Error(http.StatusForbidden, err)
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+
+	// The count is kept in the bucket so all proxy instances share it.
+	// Concurrent downloads of the same link may race and be undercounted.
+	countKey := path.Join(p.SignedURLs.StatePrefix, signature+".count")
+	count := 0
+	obj, err := p.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(p.Bucket),
+		Key:    aws.String(countKey),
+	})
+	if err == nil {
+		buf, readErr := ioutil.ReadAll(obj.Body)
+		obj.Body.Close()
+		if readErr != nil {
+			return nil, convertToCaddyError(readErr)
+		}
+		count, _ = strconv.Atoi(strings.TrimSpace(string(buf)))
+	} else if convertToCaddyError(err).StatusCode != http.StatusNotFound {
+		return nil, convertToCaddyError(err)
+	}
+
+	if count >= limit {
+		return nil, caddyhttp.Error(http.StatusForbidden, errors.New("download limit reached"))
+	}
+	return &signedDownload{countKey: countKey, count: count}, nil
+}
+
+// countDownload records a download of a limited link after the object was served. Only requests
+// for the start of the object count, so the later Range requests of one download don't.
+func (p S3Proxy) countDownload(r *http.Request, download *signedDownload) {
+	if start, _, ok := parseByteRange(r.Header.Get("Range")); !ok || start != 0 {
+		return
+	}
+	_, err := p.client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(p.Bucket),
+		Key:    aws.String(download.countKey),
+		Body:   bytes.NewReader([]byte(strconv.Itoa(download.count + 1))),
+	})
+	if err != nil {
+		p.log.Error("could not count download",
+			zap.String("bucket", p.Bucket),
+			zap.String("key", download.countKey),
+			zap.String("err", err.Error()),
+		)
+	}
+}
+
+// IssueSignedURLHandler signs a share link for the path asked for.
+func (p S3Proxy) IssueSignedURLHandler(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+	if !bearerAuthorized(r, p.SignedURLs.AdminTokens) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return caddyhttp.Error(http.StatusUnauthorized, errors.New("not authorized to issue links"))
+	}
+
+	var req SignedURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if !strings.HasPrefix(req.Path, "/") || strings.HasSuffix(req.Path, "/") {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("path must name an object"))
+	}
+	if req.MaxDownloads < 0 {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("invalid max_downloads"))
+	}
+
+	expiresIn := time.Duration(req.ExpiresIn)
+	if expiresIn <= 0 {
+		expiresIn = p.SignedURLs.maxExpiry()
+	}
+	if expiresIn > p.SignedURLs.maxExpiry() {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("expires_in can not be more than %v", p.SignedURLs.maxExpiry()))
+	}
+
+	expires := time.Now().Add(expiresIn)
+	key := p.SignedURLs.Keys[0]
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("kid", key.ID)
+	if req.MaxDownloads > 0 {
+		query.Set("limit", strconv.Itoa(req.MaxDownloads))
+	}
+	query.Set("signature", signURL(key.Secret, http.MethodGet, req.Path, expires.Unix(), req.MaxDownloads))
+	link := url.URL{Path: req.Path, RawQuery: query.Encode()}
+
+	p.log.Info("issued signed url",
+		zap.String("path", req.Path),
+		zap.Time("expires", expires),
+		zap.Int("max_downloads", req.MaxDownloads),
+	)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(w).Encode(SignedURLResponse{
+		URL:     link.String(),
+		Expires: expires.UTC(),
+	})
+}
@@ -0,0 +1,253 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestVerifySignedURL(t *testing.T) {
+	c := SignedURLConfig{
+		Keys: []SigningKey{
+			{ID: "new", Secret: "new-secret"},
+			{ID: "old", Secret: "old-secret"},
+		},
+	}
+	now := time.Unix(1700000000, 0)
+	future := strconv.FormatInt(now.Unix()+60, 10)
+	past := strconv.FormatInt(now.Unix()-60, 10)
+
+	sig := func(secret string, urlPath string, expires string, limit int) string {
+		e, _ := strconv.ParseInt(expires, 10, 64)
+		return signURL(secret, http.MethodGet, urlPath, e, limit)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		target    string
+		shouldErr bool
+	}{
+		{
+			name:   "valid with current key",
+			target: "/file.zip?expires=" + future + "&kid=new&signature=" + sig("new-secret", "/file.zip", future, 0),
+		},
+		{
+			name:   "valid with rotated key",
+			target: "/file.zip?expires=" + future + "&kid=old&signature=" + sig("old-secret", "/file.zip", future, 0),
+		},
+		{
+			name:   "valid without kid",
+			target: "/file.zip?expires=" + future + "&signature=" + sig("old-secret", "/file.zip", future, 0),
+		},
+		{
+			name:   "valid with limit",
+			target: "/file.zip?expires=" + future + "&limit=3&signature=" + sig("new-secret", "/file.zip", future, 3),
+		},
+		{
+			name:      "limit was tampered with",
+			target:    "/file.zip?expires=" + future + "&limit=30&signature=" + sig("new-secret", "/file.zip", future, 3),
+			shouldErr: true,
+		},
+		{
+			name:      "wrong path",
+			target:    "/other.zip?expires=" + future + "&signature=" + sig("new-secret", "/file.zip", future, 0),
+			shouldErr: true,
+		},
+		{
+			name:      "expired",
+			target:    "/file.zip?expires=" + past + "&signature=" + sig("new-secret", "/file.zip", past, 0),
+			shouldErr: true,
+		},
+		{
+			name:      "unknown key",
+			target:    "/file.zip?expires=" + future + "&signature=" + sig("nope", "/file.zip", future, 0),
+			shouldErr: true,
+		},
+		{
+			name:      "missing signature",
+			target:    "/file.zip?expires=" + future,
+			shouldErr: true,
+		},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		_, _, err := c.verifySignedURL(req, now)
+		if tc.shouldErr && err == nil {
+			t.Errorf("Test '%s' expected an error", tc.name)
+		}
+		if !tc.shouldErr && err != nil {
+			t.Errorf("Test '%s' unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestIssueSignedURL(t *testing.T) {
+	p := S3Proxy{
+		SignedURLs: &SignedURLConfig{
+			Keys:        []SigningKey{{ID: "k1", Secret: "s3cr3t"}},
+			IssuePath:   "/admin/share",
+			AdminTokens: []string{"admin"},
+		},
+		log: zap.NewNop(),
+	}
+
+	body := []byte(`{"path": "/reports/q3.pdf", "expires_in": 3600000000000}`)
+	req := httptest.NewRequest(http.MethodPost, "/admin/share", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin")
+	recorder := httptest.NewRecorder()
+	if err := p.IssueSignedURLHandler(recorder, req); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp SignedURLResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// The link we got must pass validation
+	if _, _, err := p.SignedURLs.verifySignedURL(httptest.NewRequest(http.MethodGet, resp.URL, nil), time.Now()); err != nil {
+		t.Errorf("Issued link '%s' does not validate: %v", resp.URL, err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/share", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer wrong")
+	if err := p.IssueSignedURLHandler(httptest.NewRecorder(), req); err == nil {
+		t.Errorf("Expected issuing with a bad token to fail")
+	}
+}
+
+func TestSignedURLRewrittenPath(t *testing.T) {
+	p := S3Proxy{
+		SignedURLs: &SignedURLConfig{
+			Keys:        []SigningKey{{ID: "k1", Secret: "s3cr3t"}},
+			IssuePath:   "/admin/share",
+			AdminTokens: []string{"admin"},
+		},
+		log: zap.NewNop(),
+	}
+	// rewritten returns a request for target whose path was rewritten to urlPath
+	rewritten := func(method string, target string, urlPath string, body []byte) *http.Request {
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		ctx := context.WithValue(req.Context(), caddyhttp.OriginalRequestCtxKey, *req.Clone(req.Context()))
+		ctx = context.WithValue(ctx, caddy.ReplacerCtxKey, caddy.NewReplacer())
+		req = req.WithContext(ctx)
+		req.URL.Path = urlPath
+		return req
+	}
+
+	// The issue path is matched against what the client asked for
+	req := rewritten(http.MethodPost, "/admin/share", "/site/admin/share", []byte(`{"path": "/file.zip"}`))
+	req.Header.Set("Authorization", "Bearer admin")
+	recorder := httptest.NewRecorder()
+	if err := p.ServeHTTP(recorder, req, nil); err != nil {
+		t.Fatal(err)
+	}
+	var resp SignedURLResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// The link is checked against what the client asked for too
+	req = rewritten(http.MethodGet, resp.URL, "/site/file.zip", nil)
+	if _, _, err := p.SignedURLs.verifySignedURL(req, time.Now()); err != nil {
+		t.Errorf("Issued link '%s' does not validate after a rewrite: %v", resp.URL, err)
+	}
+	req = rewritten(http.MethodGet, strings.Replace(resp.URL, "/file.zip", "/site/file.zip", 1), "/file.zip", nil)
+	if _, _, err := p.SignedURLs.verifySignedURL(req, time.Now()); err == nil {
+		t.Errorf("Expected the link to fail for another requested path")
+	}
+}
+
+func TestSignedURLDownloadLimit(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string][]byte{"file.zip": []byte("0123456789")}
+	stub, client := newStubS3Client(t, func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/mybucket/")
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			objects[key], _ = ioutil.ReadAll(r.Body)
+		case http.MethodGet:
+			content, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}
+	})
+	defer stub.Close()
+	proxy := S3Proxy{
+		Bucket:    "mybucket",
+		EnablePut: true,
+		SignedURLs: &SignedURLConfig{
+			Keys:        []SigningKey{{ID: "k1", Secret: "s3cr3t"}},
+			StatePrefix: defaultSignedURLStatePrefix,
+		},
+		client: client,
+		log:    zap.NewNop(),
+	}
+
+	expires := time.Now().Add(time.Hour).Unix()
+	link := func(urlPath string) string {
+		return urlPath + "?expires=" + strconv.FormatInt(expires, 10) + "&limit=1&signature=" +
+			signURL("s3cr3t", http.MethodGet, urlPath, expires, 1)
+	}
+	serve := func(method string, target string, headers map[string]string) int {
+		req := httptest.NewRequest(method, target, bytes.NewReader([]byte("0")))
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		recorder := httptest.NewRecorder()
+		_ = proxy.ServeHTTP(recorder, req, nil)
+		return recorder.Code
+	}
+
+	// A missing object and a later part of the file don't use up the download
+	if code := serve(http.MethodGet, link("/missing.zip"), nil); code != http.StatusNotFound {
+		t.Errorf("Expected a 404 for a missing object, got %d", code)
+	}
+	if code := serve(http.MethodGet, link("/missing.zip"), nil); code != http.StatusNotFound {
+		t.Errorf("Expected a 404 again for a missing object, got %d", code)
+	}
+	if code := serve(http.MethodGet, link("/file.zip"), map[string]string{"Range": "bytes=5-"}); code != http.StatusOK {
+		t.Errorf("Expected the range to be served, got %d", code)
+	}
+	if code := serve(http.MethodGet, link("/file.zip"), nil); code != http.StatusOK {
+		t.Errorf("Expected the download to be served, got %d", code)
+	}
+
+	// The count can't be reset by a client
+	mu.Lock()
+	var countKey string
+	for key := range objects {
+		if strings.HasPrefix(key, ".signed/") {
+			countKey = key
+		}
+	}
+	mu.Unlock()
+	if countKey == "" {
+		t.Fatal("Expected the download to be counted")
+	}
+	if code := serve(http.MethodPut, "/"+countKey, nil); code != http.StatusForbidden {
+		t.Errorf("Expected a PUT of the count to be refused, got %d", code)
+	}
+
+	if code := serve(http.MethodGet, link("/file.zip"), nil); code != http.StatusForbidden {
+		t.Errorf("Expected the download limit to be reached, got %d", code)
+	}
+}
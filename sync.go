@@ -0,0 +1,233 @@
+package caddys3proxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// The metadata key objects written by the proxy keep their SHA-256 in (when sync is enabled)
+const sha256MetadataKey = "Sha256"
+
+// SyncEntry is one file of a sync manifest.
+type SyncEntry struct {
+	Key    string `json:"key"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// SyncManifest is the JSON body POSTed to sync a prefix. Keys are relative to the prefix.
+type SyncManifest struct {
+	Files []SyncEntry `json:"files"`
+}
+
+// SyncResult tells the client which keys (relative to the prefix) need uploading
+// and which existing keys are not in the manifest.
+type SyncResult struct {
+	Upload  []string `json:"upload"`
+	Delete  []string `json:"delete"`
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// sha256Hex returns the hex SHA-256 of buf
+func sha256Hex(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// isSyncRequest returns true if the request asks for a sync
+func isSyncRequest(r *http.Request) bool {
+	_, ok := r.URL.Query()["sync"]
+	return ok
+}
+
+// storedSHA256 returns the hex SHA-256 of an object from its metadata or S3 checksum, if it has one.
+func (p S3Proxy) storedSHA256(key string) (string, error) {
+	head, err := p.client.HeadObject(&s3.HeadObjectInput{
+		Bucket:       aws.String(p.Bucket),
+		Key:          aws.String(key),
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	})
+	if err != nil {
+		return "", err
+	}
+	if sum, ok := head.Metadata[sha256MetadataKey]; ok && sum != nil {
+		return strings.ToLower(*sum), nil
+	}
+	if head.ChecksumSHA256 != nil {
+		// Checksums of multipart uploads look like "<base64>-<parts>" and are not a hash of the object
+		if raw, err := base64.StdEncoding.DecodeString(*head.ChecksumSHA256); err == nil {
+			return hex.EncodeToString(raw), nil
+		}
+	}
+	return "", nil
+}
+
+// listPrefix returns the size of every object under the prefix dirKey
+func (p S3Proxy) listPrefix(dirKey string) (map[string]int64, error) {
+	existing := make(map[string]int64)
+	err := p.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(p.Bucket),
+		Prefix: aws.String(strings.TrimPrefix(dirKey, "/")),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			existing["/"+aws.StringValue(obj.Key)] = aws.Int64Value(obj.Size)
+		}
+		return true
+	})
+	return existing, err
+}
+
+// SyncHandler compares a manifest with the objects under dirKey. With ?sync=commit
+// the objects that are not in the manifest are deleted, if deletes are enabled.
+func (p S3Proxy) SyncHandler(w http.ResponseWriter, r *http.Request, dirKey string) error {
+	commit := r.URL.Query().Get("sync") == "commit"
+	if commit && !p.EnableDelete {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("sync commit needs enable_delete"))
+	}
+
+	var manifest SyncManifest
+	if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	wanted := make(map[string]SyncEntry)
+	for _, entry := range manifest.Files {
+		key, err := deployEntryKey(dirKey, entry.Key)
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		if _, err := hex.DecodeString(entry.SHA256); err != nil || len(entry.SHA256) != 64 {
+			return caddyhttp.Error(http.StatusBadRequest, errors.New("invalid sha256 for "+entry.Key))
+		}
+		entry.SHA256 = strings.ToLower(entry.SHA256)
+		wanted[key] = entry
+	}
+
+	existing, err := p.listPrefix(dirKey)
+	if err != nil {
+		return convertToCaddyError(err)
+	}
+
+	result := SyncResult{Upload: []string{}, Delete: []string{}}
+	relative := func(key string) string {
+		return strings.TrimPrefix(key, dirKey)
+	}
+
+	// Objects with the same size need their checksum looked up, do that in parallel
+	concurrency := p.DeployConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultDeployConcurrency
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	slots := make(chan struct{}, concurrency)
+
+	for key, entry := range wanted {
+		size, ok := existing[key]
+		if !ok || size != entry.Size {
+			mu.Lock()
+			result.Upload = append(result.Upload, relative(key))
+			mu.Unlock()
+			continue
+		}
+
+		key, entry := key, entry
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			sum, err := p.storedSHA256(key)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			if sum != entry.SHA256 {
+				result.Upload = append(result.Upload, relative(key))
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return convertToCaddyError(firstErr)
+	}
+
+	var stale []string
+	for key := range existing {
+		if _, ok := wanted[key]; ok || fileHidden(key, p.Hide) {
+			continue
+		}
+		stale = append(stale, key)
+		result.Delete = append(result.Delete, relative(key))
+	}
+	sort.Strings(result.Upload)
+	sort.Strings(result.Delete)
+
+	if commit && len(stale) > 0 {
+		deleted, err := p.deleteKeys(stale)
+		for _, key := range deleted {
+			result.Deleted = append(result.Deleted, relative(key))
+		}
+		sort.Strings(result.Deleted)
+		if err != nil {
+			return convertToCaddyError(err)
+		}
+		p.log.Info("sync deleted stale objects",
+			zap.String("bucket", p.Bucket),
+			zap.String("prefix", dirKey),
+			zap.Int("deleted", len(deleted)),
+		)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(result)
+}
+
+// deleteKeys deletes keys in batches of 1000 (the most DeleteObjects takes) and returns the ones deleted
+func (p S3Proxy) deleteKeys(keys []string) ([]string, error) {
+	var deleted []string
+	for start := 0; start < len(keys); start += 1000 {
+		end := start + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var objects []*s3.ObjectIdentifier
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(strings.TrimPrefix(key, "/"))})
+		}
+		out, err := p.client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(p.Bucket),
+			Delete: &s3.Delete{Objects: objects},
+		})
+		if err != nil {
+			return deleted, err
+		}
+		for _, obj := range out.Deleted {
+			deleted = append(deleted, "/"+aws.StringValue(obj.Key))
+		}
+		if len(out.Errors) > 0 {
+			return deleted, errors.New("could not delete " + aws.StringValue(out.Errors[0].Key) + ": " + aws.StringValue(out.Errors[0].Message))
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,113 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestSync(t *testing.T) {
+	client := newS3Client(t)
+	bucketName := setupTestBucket(t, client)
+
+	proxy := S3Proxy{
+		Bucket:       bucketName,
+		EnablePut:    true,
+		EnableDelete: true,
+		EnableSync:   true,
+		client:       client,
+		log:          zap.NewExample(),
+	}
+
+	serve := func(method string, target string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		recorder := httptest.NewRecorder()
+		_ = proxy.ServeHTTP(recorder, req, nil)
+		return recorder
+	}
+
+	// What is in the bucket now
+	for key, content := range map[string]string{
+		"same.txt":    "same",
+		"changed.txt": "old!",
+		"stale.txt":   "stale",
+	} {
+		if resp := serve(http.MethodPut, "/sync/"+key, []byte(content)); resp.Code != http.StatusOK {
+			t.Fatalf("Could not put %s: %d", key, resp.Code)
+		}
+	}
+
+	manifest, err := json.Marshal(SyncManifest{Files: []SyncEntry{
+		{Key: "same.txt", SHA256: sha256Hex([]byte("same")), Size: 4},
+		{Key: "changed.txt", SHA256: sha256Hex([]byte("new!")), Size: 4},
+		{Key: "new/file.txt", SHA256: sha256Hex([]byte("new")), Size: 3},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/sync/?sync", "/sync/?sync=commit"} {
+		resp := serve(http.MethodPost, target, manifest)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected code %d, got %d", http.StatusOK, resp.Code)
+		}
+		var result SyncResult
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result.Upload, []string{"changed.txt", "new/file.txt"}) {
+			t.Errorf("Unexpected keys to upload %v", result.Upload)
+		}
+		if !reflect.DeepEqual(result.Delete, []string{"stale.txt"}) {
+			t.Errorf("Unexpected keys to delete %v", result.Delete)
+		}
+		if target == "/sync/?sync=commit" && !reflect.DeepEqual(result.Deleted, []string{"stale.txt"}) {
+			t.Errorf("Expected commit to delete stale.txt, got %v", result.Deleted)
+		}
+	}
+
+	if resp := serve(http.MethodGet, "/sync/stale.txt", nil); resp.Code != http.StatusNotFound {
+		t.Errorf("Expected stale.txt to be gone, got %d", resp.Code)
+	}
+}
+
+func TestSyncCommitNeedsDelete(t *testing.T) {
+	client := newS3Client(t)
+	bucketName := setupTestBucket(t, client)
+
+	proxy := S3Proxy{
+		Bucket:     bucketName,
+		EnablePut:  true,
+		EnableSync: true,
+		client:     client,
+		log:        zap.NewExample(),
+	}
+
+	serve := func(method string, target string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		recorder := httptest.NewRecorder()
+		_ = proxy.ServeHTTP(recorder, req, nil)
+		return recorder
+	}
+
+	if resp := serve(http.MethodPut, "/keep/stale.txt", []byte("stale")); resp.Code != http.StatusOK {
+		t.Fatalf("Could not put stale.txt: %d", resp.Code)
+	}
+
+	// An empty manifest would make every key under the prefix stale
+	if resp := serve(http.MethodPost, "/keep/?sync=commit", []byte(`{"files": []}`)); resp.Code != http.StatusForbidden {
+		t.Errorf("Expected code %d, got %d", http.StatusForbidden, resp.Code)
+	}
+	if resp := serve(http.MethodGet, "/keep/stale.txt", nil); resp.Code != http.StatusOK {
+		t.Errorf("Expected stale.txt to be kept, got %d", resp.Code)
+	}
+}
@@ -0,0 +1,170 @@
+package caddys3proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+// TransportConfig tunes the HTTP transport used to talk to S3.
+type TransportConfig struct {
+	// Most idle connections kept, in total and to one host. Defaults are 100 and 2 (the Go defaults).
+	MaxIdleConns        int `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
+
+	// How long an idle connection is kept. Default is 90s.
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+
+	// How long connecting may take. Default is 30s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+
+	// How long to wait for the response headers after sending a request. 0 means no limit.
+	ResponseHeaderTimeout caddy.Duration `json:"response_header_timeout,omitempty"`
+
+	// PEM files of CAs trusted on top of the system ones, like the CA of an on-prem MinIO
+	TLSCAFiles []string `json:"tls_ca_files,omitempty"`
+
+	// Server name to verify the certificate against, instead of the host of the endpoint
+	TLSServerName string `json:"tls_server_name,omitempty"`
+
+	// Lowest TLS version allowed, "1.2" or "1.3". Default is 1.2.
+	TLSMinVersion string `json:"tls_min_version,omitempty"`
+
+	// Don't verify the certificate of S3. Only for testing.
+	TLSInsecureSkipVerify bool `json:"tls_insecure_skip_verify,omitempty"`
+
+	// URL of an HTTP proxy to go through. Default is the HTTP_PROXY and HTTPS_PROXY env values.
+	Proxy string `json:"proxy,omitempty"`
+
+	// HTTP versions to use, "1.1" and "2". Default is both, preferring 2.
+	Versions []string `json:"versions,omitempty"`
+
+	// Use the dual-stack (IPv4 and IPv6) endpoints of S3
+	DualStack bool `json:"dual_stack,omitempty"`
+
+	// Use the FIPS endpoints of S3
+	FIPS bool `json:"fips,omitempty"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// validate checks the options that would only fail when the transport is made
+func (c TransportConfig) validate() error {
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("max idle connections can not be negative")
+	}
+	if _, ok := tlsVersions[c.TLSMinVersion]; c.TLSMinVersion != "" && !ok {
+		return fmt.Errorf("tls_min_version '%s' must be 1.2 or 1.3", c.TLSMinVersion)
+	}
+	for _, version := range c.Versions {
+		if version != "1.1" && version != "2" {
+			return fmt.Errorf("HTTP version '%s' must be 1.1 or 2", version)
+		}
+	}
+	if c.Proxy != "" {
+		if u, err := url.Parse(c.Proxy); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("proxy '%s' is not a valid URL", c.Proxy)
+		}
+	}
+	return nil
+}
+
+// newTransport returns a copy of the default transport with the options applied
+func (c *TransportConfig) newTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c == nil {
+		return transport, nil
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	if c.MaxIdleConns > 0 {
+		transport.MaxIdleConns = c.MaxIdleConns
+	}
+	if c.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	}
+	if c.IdleTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(c.IdleTimeout)
+	}
+	if c.DialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   time.Duration(c.DialTimeout),
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	transport.ResponseHeaderTimeout = time.Duration(c.ResponseHeaderTimeout)
+
+	if c.Proxy != "" {
+		proxyURL, _ := url.Parse(c.Proxy)
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         c.TLSServerName,
+		InsecureSkipVerify: c.TLSInsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if c.TLSMinVersion != "" {
+		tlsConfig.MinVersion = tlsVersions[c.TLSMinVersion]
+	}
+	if len(c.TLSCAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range c.TLSCAFiles {
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("reading CA file: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA file %s", file)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	if len(c.Versions) > 0 && !c.allows("2") {
+		// A non-nil empty map turns HTTP/2 off
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport, nil
+}
+
+func (c TransportConfig) allows(version string) bool {
+	for _, v := range c.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// applyEndpointOptions sets the dual-stack and FIPS options on config
+func (c *TransportConfig) applyEndpointOptions(config *aws.Config) {
+	if c == nil {
+		return
+	}
+	if c.DualStack {
+		config.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+	if c.FIPS {
+		config.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+}
@@ -0,0 +1,95 @@
+package caddys3proxy
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	caddy "github.com/caddyserver/caddy/v2"
+)
+
+func TestNewTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(c *TransportConfig) error {
+		transport, err := c.newTransport()
+		if err != nil {
+			return err
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if err := get(nil); err == nil {
+		t.Error("Expected the certificate of the test server not to be trusted by default")
+	}
+	if err := get(&TransportConfig{TLSCAFiles: []string{caFile}}); err != nil {
+		t.Errorf("Expected the CA file to be trusted, got %v", err)
+	}
+	if err := get(&TransportConfig{TLSCAFiles: []string{filepath.Join(dir, "missing.pem")}}); err == nil {
+		t.Error("Expected an error for a missing CA file")
+	}
+
+	transport, err := (&TransportConfig{
+		MaxIdleConns:        10,
+		MaxIdleConnsPerHost: 5,
+		IdleTimeout:         caddy.Duration(time.Minute),
+		TLSMinVersion:       "1.3",
+		Proxy:               "http://proxy.local:3128",
+		Versions:            []string{"1.1"},
+	}).newTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.MaxIdleConns != 10 || transport.MaxIdleConnsPerHost != 5 || transport.IdleConnTimeout != time.Minute {
+		t.Errorf("Unexpected connection pool settings %d %d %v", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+	if transport.TLSClientConfig.MinVersion != tlsVersions["1.3"] {
+		t.Errorf("Unexpected TLS min version %x", transport.TLSClientConfig.MinVersion)
+	}
+	if transport.ForceAttemptHTTP2 || transport.TLSNextProto == nil {
+		t.Error("Expected HTTP/2 to be off")
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://s3.amazonaws.com/", nil)
+	proxyURL, err := transport.Proxy(req)
+	if err != nil || proxyURL == nil || proxyURL.Host != "proxy.local:3128" {
+		t.Errorf("Unexpected proxy %v %v", proxyURL, err)
+	}
+
+	if _, err := (&TransportConfig{TLSMinVersion: "1.0"}).newTransport(); err == nil {
+		t.Error("Expected an error for TLS 1.0")
+	}
+}
+
+func TestApplyEndpointOptions(t *testing.T) {
+	var config aws.Config
+	(&TransportConfig{DualStack: true, FIPS: true}).applyEndpointOptions(&config)
+	if config.UseDualStackEndpoint != endpoints.DualStackEndpointStateEnabled || config.UseFIPSEndpoint != endpoints.FIPSEndpointStateEnabled {
+		t.Errorf("Expected dual-stack and FIPS endpoints, got %v %v", config.UseDualStackEndpoint, config.UseFIPSEndpoint)
+	}
+}
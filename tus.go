@@ -0,0 +1,480 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+
+	// The query param used to identify an upload in its URL
+	tusIDParam = "tus_id"
+
+	// S3 requires every part but the last of a multipart upload to be at least 5MiB.
+	// Data that does not fill a part yet is kept in a "tail" object next to the state.
+	tusPartSize = 5 * 1024 * 1024
+
+	defaultTusStatePrefix = "/.tus/"
+)
+
+// Locks of the uploads being PATCHed or terminated by this instance, upload ids are random so
+// they are shared by all handlers
+var tusLocks = newKeyedMutex()
+
+// keyedMutex serialises the requests for the same key
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu    sync.Mutex
+	users int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+// lock waits for key to be free and returns the function that frees it again
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.users++
+	k.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		k.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// tusUpload is the state of a resumable upload. It is stored as JSON in the bucket so any
+// instance of the proxy can continue the upload.
+type tusUpload struct {
+	ID          string            `json:"id"`
+	Key         string            `json:"key"`
+	UploadID    string            `json:"upload_id,omitempty"`
+	Length      int64             `json:"length"`
+	Parts       []tusPart         `json:"parts,omitempty"`
+	TailSize    int64             `json:"tail_size,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Completed   bool              `json:"completed,omitempty"`
+	Created     time.Time         `json:"created"`
+}
+
+type tusPart struct {
+	Number int64  `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+// partsSize returns the number of bytes already stored in multipart upload parts
+func (u tusUpload) partsSize() int64 {
+	var size int64
+	for _, part := range u.Parts {
+		size += part.Size
+	}
+	return size
+}
+
+// Offset returns the number of bytes of the upload received so far
+func (u tusUpload) Offset() int64 {
+	return u.partsSize() + u.TailSize
+}
+
+// isTusRequest returns true if the request is meant for the tus protocol handler. OPTIONS requests
+// are only claimed when they are about an upload or are a CORS preflight for the tus headers.
+func isTusRequest(r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != "" {
+		return true
+	}
+	if r.Method != http.MethodOptions {
+		return false
+	}
+	return r.URL.Query().Get(tusIDParam) != "" ||
+		strings.Contains(strings.ToLower(r.Header.Get("Access-Control-Request-Headers")), "tus-resumable")
+}
+
+func (p S3Proxy) tusStateKey(id string, suffix string) string {
+	return path.Join(p.TusStatePrefix, id+suffix)
+}
+
+// TusHandler implements the core tus 1.0 protocol plus the creation and termination extensions.
+// Each upload is backed by an S3 multipart upload of key.
+func (p S3Proxy) TusHandler(w http.ResponseWriter, r *http.Request, key string) error {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		return caddyhttp.Error(http.StatusPreconditionFailed, errors.New("unsupported tus version"))
+	}
+
+	if strings.HasSuffix(key, "/") || fileHidden(key, p.Hide) {
+		return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+
+	if r.Method == http.MethodPost {
+		return p.tusCreate(w, r, key)
+	}
+
+	id := r.URL.Query().Get(tusIDParam)
+	if !validTusID(id) {
+		return caddyhttp.Error(http.StatusNotFound, errors.New("unknown upload"))
+	}
+	if r.Method == http.MethodPatch || r.Method == http.MethodDelete {
+		// The state must not change between loading it and writing it back
+		unlock := tusLocks.lock(id)
+		defer unlock()
+	}
+	upload, err := p.loadTusUpload(id)
+	if err != nil {
+		return err
+	}
+	if upload.Key != key {
+		// The upload exists but it is not for this URL
+		return caddyhttp.Error(http.StatusNotFound, errors.New("unknown upload"))
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset(), 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case http.MethodPatch:
+		return p.tusPatch(w, r, upload)
+	case http.MethodDelete:
+		return p.tusTerminate(w, upload)
+	}
+
+	return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
+
+func (p S3Proxy) tusCreate(w http.ResponseWriter, r *http.Request, key string) error {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("invalid Upload-Length"))
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return convertToCaddyError(err)
+	}
+
+	upload := tusUpload{
+		ID:       hex.EncodeToString(idBytes),
+		Key:      key,
+		Length:   length,
+		Metadata: parseTusMetadata(r.Header.Get("Upload-Metadata")),
+		Created:  time.Now().UTC(),
+	}
+	if ct, ok := upload.Metadata["filetype"]; ok {
+		upload.ContentType = ct
+	} else if ct, ok := upload.Metadata["contentType"]; ok {
+		upload.ContentType = ct
+	}
+
+	if length == 0 {
+		// Nothing will ever be PATCHed, just write the empty object
+		_, err = p.client.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(p.Bucket),
+			Key:         aws.String(key),
+			ContentType: makeAwsString(upload.ContentType),
+			Body:        bytes.NewReader(nil),
+		})
+		if err != nil {
+			return convertToCaddyError(err)
+		}
+		p.forgetNotFound(key)
+		upload.Completed = true
+	} else {
+		mpu, err := p.client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:      aws.String(p.Bucket),
+			Key:         aws.String(key),
+			ContentType: makeAwsString(upload.ContentType),
+		})
+		if err != nil {
+			return convertToCaddyError(err)
+		}
+		upload.UploadID = *mpu.UploadId
+	}
+
+	if err := p.saveTusUpload(upload); err != nil {
+		return err
+	}
+
+	p.log.Debug("tus upload created",
+		zap.String("bucket", p.Bucket),
+		zap.String("key", key),
+		zap.String("id", upload.ID),
+		zap.Int64("length", length),
+	)
+
+	// The Location must be what the client asked for, not a rewritten URI
+	location := originalURL(r)
+	query := location.Query()
+	query.Set(tusIDParam, upload.ID)
+	location.RawQuery = query.Encode()
+	w.Header().Set("Location", location.RequestURI())
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (p S3Proxy) tusPatch(w http.ResponseWriter, r *http.Request, upload *tusUpload) error {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return caddyhttp.Error(http.StatusUnsupportedMediaType, errors.New("invalid Content-Type"))
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("invalid Upload-Offset"))
+	}
+	if offset != upload.Offset() || upload.Completed {
+		return caddyhttp.Error(http.StatusConflict, errors.New("Upload-Offset does not match"))
+	}
+
+	// Any data left over from the previous PATCH goes first
+	var reader io.Reader = io.LimitReader(r.Body, upload.Length-offset)
+	if upload.TailSize > 0 {
+		tail, err := p.client.GetObjectWithContext(r.Context(), &s3.GetObjectInput{
+			Bucket: aws.String(p.Bucket),
+			Key:    aws.String(p.tusStateKey(upload.ID, ".tail")),
+		})
+		if err != nil {
+			return convertToCaddyError(err)
+		}
+		defer tail.Body.Close()
+		reader = io.MultiReader(tail.Body, reader)
+	}
+
+	hadTail := upload.TailSize > 0
+	partsSize := upload.partsSize()
+	buf := make([]byte, tusPartSize)
+	for {
+		// Any read error just means the client stopped sending, keep what we got so far
+		n, readErr := io.ReadFull(reader, buf)
+		if n == 0 {
+			break
+		}
+
+		if n < tusPartSize && partsSize+int64(n) < upload.Length {
+			// Not enough for a part, keep it for the next PATCH
+			_, err = p.client.PutObject(&s3.PutObjectInput{
+				Bucket: aws.String(p.Bucket),
+				Key:    aws.String(p.tusStateKey(upload.ID, ".tail")),
+				Body:   bytes.NewReader(buf[:n]),
+			})
+			if err != nil {
+				return convertToCaddyError(err)
+			}
+			upload.TailSize = int64(n)
+			break
+		}
+
+		partNumber := int64(len(upload.Parts) + 1)
+		part, err := p.client.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String(p.Bucket),
+			Key:        aws.String(upload.Key),
+			UploadId:   aws.String(upload.UploadID),
+			PartNumber: aws.Int64(partNumber),
+			Body:       bytes.NewReader(buf[:n]),
+		})
+		if err != nil {
+			return convertToCaddyError(err)
+		}
+		upload.Parts = append(upload.Parts, tusPart{Number: partNumber, ETag: aws.StringValue(part.ETag), Size: int64(n)})
+		upload.TailSize = 0
+		partsSize += int64(n)
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	if hadTail && upload.TailSize == 0 {
+		p.deleteTusObject(p.tusStateKey(upload.ID, ".tail"))
+	}
+
+	if partsSize == upload.Length {
+		if err := p.tusComplete(upload); err != nil {
+			return err
+		}
+	} else if err := p.saveTusUpload(*upload); err != nil {
+		return err
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset(), 10))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (p S3Proxy) tusComplete(upload *tusUpload) error {
+	var parts []*s3.CompletedPart
+	for _, part := range upload.Parts {
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int64(part.Number),
+		})
+	}
+	_, err := p.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(p.Bucket),
+		Key:             aws.String(upload.Key),
+		UploadId:        aws.String(upload.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return convertToCaddyError(err)
+	}
+	p.forgetNotFound(upload.Key)
+
+	p.log.Debug("tus upload completed",
+		zap.String("bucket", p.Bucket),
+		zap.String("key", upload.Key),
+		zap.String("id", upload.ID),
+	)
+
+	// Keep the state around (marked completed) so a HEAD still reports the final offset
+	upload.Completed = true
+	return p.saveTusUpload(*upload)
+}
+
+func (p S3Proxy) tusTerminate(w http.ResponseWriter, upload *tusUpload) error {
+	if !upload.Completed {
+		_, err := p.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(p.Bucket),
+			Key:      aws.String(upload.Key),
+			UploadId: aws.String(upload.UploadID),
+		})
+		if err != nil {
+			return convertToCaddyError(err)
+		}
+	}
+
+	p.deleteTusObject(p.tusStateKey(upload.ID, ".tail"))
+	p.deleteTusObject(p.tusStateKey(upload.ID, ".json"))
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (p S3Proxy) loadTusUpload(id string) (*tusUpload, error) {
+	obj, err := p.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(p.Bucket),
+		Key:    aws.String(p.tusStateKey(id, ".json")),
+	})
+	if err != nil {
+		return nil, convertToCaddyError(err)
+	}
+	defer obj.Body.Close()
+
+	var upload tusUpload
+	if err := json.NewDecoder(obj.Body).Decode(&upload); err != nil {
+		return nil, convertToCaddyError(err)
+	}
+	return &upload, nil
+}
+
+func (p S3Proxy) saveTusUpload(upload tusUpload) error {
+	buf, err := json.Marshal(upload)
+	if err != nil {
+		return convertToCaddyError(err)
+	}
+	_, err = p.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(p.Bucket),
+		Key:         aws.String(p.tusStateKey(upload.ID, ".json")),
+		ContentType: aws.String("application/json"),
+		Body:        bytes.NewReader(buf),
+	})
+	if err != nil {
+		return convertToCaddyError(err)
+	}
+	return nil
+}
+
+// deleteTusObject deletes a state object. Failing to do so is not fatal to the upload.
+func (p S3Proxy) deleteTusObject(key string) {
+	_, err := p.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(p.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != s3.ErrCodeNoSuchKey {
+			p.log.Warn("could not delete tus state",
+				zap.String("bucket", p.Bucket),
+				zap.String("key", key),
+				zap.String("err", err.Error()),
+			)
+		}
+	}
+}
+
+// validTusID makes sure an id given by a client can only ever name our own state objects
+func validTusID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// parseTusMetadata parses the Upload-Metadata header: comma separated "key base64value" pairs.
+func parseTusMetadata(header string) map[string]string {
+	if header == "" {
+		return nil
+	}
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		var value []byte
+		if len(fields) > 1 {
+			var err error
+			value, err = base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+		}
+		metadata[fields[0]] = string(value)
+	}
+	return metadata
+}
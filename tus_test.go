@@ -0,0 +1,181 @@
+package caddys3proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	caddy "github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		header   string
+		expected map[string]string
+	}{
+		{header: "", expected: nil},
+		{
+			header:   "filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,is_confidential",
+			expected: map[string]string{"filename": "world_domination_plan.pdf", "is_confidential": ""},
+		},
+		{
+			header:   "filetype dGV4dC9wbGFpbg==, bad !!!",
+			expected: map[string]string{"filetype": "text/plain"},
+		},
+	} {
+		actual := parseTusMetadata(tc.header)
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("Parsing '%s' we expected %v but got %v", tc.header, tc.expected, actual)
+		}
+	}
+}
+
+func TestValidTusID(t *testing.T) {
+	if !validTusID("0123456789abcdef0123456789abcdef") {
+		t.Errorf("Expected a 32 char hex id to be valid")
+	}
+	for _, id := range []string{"", "../../secret", "0123456789abcdef0123456789abcdeg", "abc"} {
+		if validTusID(id) {
+			t.Errorf("Expected id '%s' to be invalid", id)
+		}
+	}
+}
+
+func TestIsTusRequest(t *testing.T) {
+	for _, tc := range []struct {
+		method   string
+		target   string
+		headers  map[string]string
+		expected bool
+	}{
+		{method: http.MethodPost, target: "/a.bin", headers: map[string]string{"Tus-Resumable": tusVersion}, expected: true},
+		{method: http.MethodOptions, target: "/a.bin?tus_id=0123456789abcdef0123456789abcdef", expected: true},
+		{method: http.MethodOptions, target: "/a.bin", headers: map[string]string{"Access-Control-Request-Headers": "tus-resumable,upload-length"}, expected: true},
+		{method: http.MethodOptions, target: "/a.bin", expected: false},
+		{method: http.MethodGet, target: "/a.bin", expected: false},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		if actual := isTusRequest(req); actual != tc.expected {
+			t.Errorf("%s %s: expected %t, got %t", tc.method, tc.target, tc.expected, actual)
+		}
+	}
+}
+
+func TestKeyedMutex(t *testing.T) {
+	k := newKeyedMutex()
+	var mu sync.Mutex
+	var running, most int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := k.lock("upload")
+			defer unlock()
+			mu.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+	}
+	// Another key is not held up
+	k.lock("other")()
+	wg.Wait()
+
+	if most != 1 {
+		t.Errorf("Expected one holder of a key at a time, got %d", most)
+	}
+	if len(k.locks) != 0 {
+		t.Errorf("Expected the locks to be dropped once free, got %d", len(k.locks))
+	}
+}
+
+func TestTusUpload(t *testing.T) {
+	client := newS3Client(t)
+	bucketName := setupTestBucket(t, client)
+
+	proxy := S3Proxy{
+		Bucket:         bucketName,
+		EnableTus:      true,
+		EnablePut:      true,
+		EnableDelete:   true,
+		TusStatePrefix: defaultTusStatePrefix,
+		client:         client,
+		log:            zap.NewExample(),
+	}
+
+	// Big enough for one full part plus a bit
+	content := bytes.Repeat([]byte("0123456789"), tusPartSize/10+500)
+
+	serve := func(method string, target string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		req.Header.Set("Tus-Resumable", tusVersion)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		recorder := httptest.NewRecorder()
+		_ = proxy.ServeHTTP(recorder, req, nil)
+		return recorder
+	}
+
+	resp := serve(http.MethodPost, "/tus/big.bin", nil, map[string]string{
+		"Upload-Length": strconv.Itoa(len(content)),
+	})
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Expected code %d on creation, got %d", http.StatusCreated, resp.Code)
+	}
+	location := resp.Header().Get("Location")
+
+	// The state of the upload can't be rewritten by clients
+	id := location[strings.Index(location, "tus_id=")+len("tus_id="):]
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		resp = serve(method, "/.tus/"+id+".json", []byte(`{}`), map[string]string{"Tus-Resumable": ""})
+		if resp.Code != http.StatusForbidden {
+			t.Errorf("Expected code %d on %s of the state, got %d", http.StatusForbidden, method, resp.Code)
+		}
+	}
+
+	// Send the data in three chunks, the first one smaller than a part
+	offset := 0
+	for _, size := range []int{1000, tusPartSize, len(content) - tusPartSize - 1000} {
+		resp = serve(http.MethodPatch, location, content[offset:offset+size], map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		})
+		if resp.Code != http.StatusNoContent {
+			t.Fatalf("Expected code %d on patch, got %d", http.StatusNoContent, resp.Code)
+		}
+		offset += size
+		if got := resp.Header().Get("Upload-Offset"); got != strconv.Itoa(offset) {
+			t.Fatalf("Expected Upload-Offset %d, got %s", offset, got)
+		}
+	}
+
+	resp = serve(http.MethodHead, location, nil, nil)
+	if resp.Header().Get("Upload-Offset") != strconv.Itoa(len(content)) {
+		t.Errorf("Expected HEAD to report a complete upload, got offset %s", resp.Header().Get("Upload-Offset"))
+	}
+
+	resp = serve(http.MethodGet, "/tus/big.bin", nil, map[string]string{"Tus-Resumable": ""})
+	if !bytes.Equal(resp.Body.Bytes(), content) {
+		t.Errorf("Uploaded object does not match what was sent (got %d bytes)", resp.Body.Len())
+	}
+}
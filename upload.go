@@ -0,0 +1,239 @@
+package caddys3proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// UploadResult describes one object written by a form upload.
+type UploadResult struct {
+	Key  string `json:"key"`
+	ETag string `json:"etag,omitempty"`
+}
+
+// formUploadFields holds the non-file form fields that apply to the file parts that follow them.
+// As with S3 POST Object, fields must come before the file parts they are meant to affect.
+type formUploadFields struct {
+	key                string
+	contentType        string
+	successRedirect    string
+	successStatus      int
+	cacheControl       string
+	contentDisposition string
+	contentEncoding    string
+	contentLanguage    string
+	metadata           map[string]*string
+}
+
+// PostHandler handles POST requests to a "directory" path.
+func (p S3Proxy) PostHandler(w http.ResponseWriter, r *http.Request, key string) error {
+	isDir := strings.HasSuffix(key, "/")
+	switch {
+	case !isDir:
+	case p.EnableSync && isSyncRequest(r):
+		return p.SyncHandler(w, r, key)
+	case p.EnableDeploy && archiveType(r.Header.Get("Content-Type")) != "":
+		return p.DeployHandler(w, r, key)
+	case p.EnableFormUpload:
+		return p.FormUploadHandler(w, r, key)
+	}
+
+	err := errors.New("method not allowed")
+	return caddyhttp.Error(http.StatusMethodNotAllowed, err)
+}
+
+// FormUploadHandler accepts a multipart/form-data body and streams each file part into S3
+// under the directory given by dirKey. It follows the S3 POST Object form semantics for the
+// key (with ${filename} substitution), Content-Type, success_action_redirect and
+// success_action_status fields.
+func (p S3Proxy) FormUploadHandler(w http.ResponseWriter, r *http.Request, dirKey string) error {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	uploader := s3manager.NewUploaderWithClient(p.client)
+
+	fields := formUploadFields{
+		metadata: make(map[string]*string),
+	}
+	var results []UploadResult
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+
+		if part.FileName() == "" {
+			// A regular form field
+			if err := fields.set(part); err != nil {
+				return err
+			}
+			continue
+		}
+
+		objKey, err := formUploadKey(dirKey, fields.key, part.FileName())
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		if fileHidden(objKey, p.Hide) {
+			return caddyhttp.Error(http.StatusForbidden, errors.New("key is hidden"))
+		}
+
+		contentType := fields.contentType
+		if contentType == "" {
+			contentType = part.Header.Get("Content-Type")
+		}
+		if contentType == "" || contentType == "application/octet-stream" {
+			if byExt := mime.TypeByExtension(path.Ext(objKey)); byExt != "" {
+				contentType = byExt
+			}
+		}
+
+		p.log.Debug("form upload to S3",
+			zap.String("bucket", p.Bucket),
+			zap.String("key", objKey),
+		)
+
+		out, err := uploader.UploadWithContext(r.Context(), &s3manager.UploadInput{
+			Bucket:             aws.String(p.Bucket),
+			Key:                aws.String(objKey),
+			CacheControl:       makeAwsString(fields.cacheControl),
+			ContentDisposition: makeAwsString(fields.contentDisposition),
+			ContentEncoding:    makeAwsString(fields.contentEncoding),
+			ContentLanguage:    makeAwsString(fields.contentLanguage),
+			ContentType:        makeAwsString(contentType),
+			Metadata:           fields.metadata,
+			Body:               part,
+		})
+		if err != nil {
+			return convertToCaddyError(err)
+		}
+		p.forgetNotFound(objKey)
+
+		result := UploadResult{Key: strings.TrimPrefix(objKey, "/")}
+		if out.ETag != nil {
+			result.ETag = *out.ETag
+		}
+		results = append(results, result)
+	}
+
+	if len(results) == 0 {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("no file in form upload"))
+	}
+
+	if fields.successRedirect != "" {
+		redirect, err := url.Parse(fields.successRedirect)
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		// Like S3 we report the bucket, key and etag of the (last) object uploaded
+		last := results[len(results)-1]
+		query := redirect.Query()
+		query.Set("bucket", p.Bucket)
+		query.Set("key", last.Key)
+		query.Set("etag", last.ETag)
+		redirect.RawQuery = query.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusSeeOther)
+		return nil
+	}
+
+	status := fields.successStatus
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(struct {
+		Uploads []UploadResult `json:"uploads"`
+	}{results})
+}
+
+// set records the value of a non-file form field.
+func (f *formUploadFields) set(part *multipart.Part) error {
+	name := part.FormName()
+
+	// Field values are small, do not let a client feed us an endless one
+	buf, err := ioutil.ReadAll(io.LimitReader(part, 8*1024+1))
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if len(buf) > 8*1024 {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("form field "+name+" too large"))
+	}
+	value := string(buf)
+
+	switch lower := strings.ToLower(name); {
+	case lower == "key":
+		f.key = value
+	case lower == "content-type":
+		f.contentType = value
+	case lower == "success_action_redirect" || lower == "redirect":
+		f.successRedirect = value
+	case lower == "success_action_status":
+		status, err := strconv.Atoi(value)
+		if err != nil || (status != http.StatusOK && status != http.StatusCreated && status != http.StatusNoContent) {
+			return caddyhttp.Error(http.StatusBadRequest, errors.New("invalid success_action_status"))
+		}
+		f.successStatus = status
+	case lower == "cache-control":
+		f.cacheControl = value
+	case lower == "content-disposition":
+		f.contentDisposition = value
+	case lower == "content-encoding":
+		f.contentEncoding = value
+	case lower == "content-language":
+		f.contentLanguage = value
+	case strings.HasPrefix(lower, "x-amz-meta-"):
+		f.metadata[strings.TrimPrefix(lower, "x-amz-meta-")] = aws.String(value)
+	}
+	return nil
+}
+
+// formUploadKey builds the S3 key for an uploaded file from the key template in the form.
+// The template is relative to dirKey and the result may not escape it.
+func formUploadKey(dirKey string, template string, filename string) (string, error) {
+	// Browsers may send the full path of the file, we only want the name
+	filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if filename == "." || filename == "/" || filename == ".." {
+		return "", errors.New("invalid file name")
+	}
+
+	if template == "" {
+		template = "${filename}"
+	}
+	rel := strings.ReplaceAll(template, "${filename}", filename)
+	if rel == "" || strings.HasSuffix(rel, "/") {
+		return "", errors.New("key must name an object")
+	}
+	for _, segment := range strings.Split(rel, "/") {
+		if segment == ".." {
+			return "", errors.New("key must not contain '..'")
+		}
+	}
+
+	return path.Join(dirKey, rel), nil
+}
@@ -0,0 +1,38 @@
+package caddys3proxy
+
+import (
+	"testing"
+)
+
+func TestFormUploadKey(t *testing.T) {
+	for _, tc := range []struct {
+		dir       string
+		template  string
+		filename  string
+		expected  string
+		shouldErr bool
+	}{
+		{dir: "/uploads/", template: "", filename: "cat.png", expected: "/uploads/cat.png"},
+		{dir: "/uploads/", template: "pics/${filename}", filename: "cat.png", expected: "/uploads/pics/cat.png"},
+		{dir: "/uploads/", template: "fixed.txt", filename: "cat.png", expected: "/uploads/fixed.txt"},
+		{dir: "/", template: "", filename: `C:\Users\me\cat.png`, expected: "/cat.png"},
+		{dir: "/uploads/", template: "", filename: "../../etc/passwd", expected: "/uploads/passwd"},
+		{dir: "/uploads/", template: "../${filename}", filename: "cat.png", shouldErr: true},
+		{dir: "/uploads/", template: "dir/", filename: "cat.png", shouldErr: true},
+		{dir: "/uploads/", template: "", filename: "..", shouldErr: true},
+	} {
+		key, err := formUploadKey(tc.dir, tc.template, tc.filename)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Expected an error for template '%s' and file '%s' but got key '%s'", tc.template, tc.filename, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for template '%s' and file '%s': %v", tc.template, tc.filename, err)
+		}
+		if key != tc.expected {
+			t.Errorf("For template '%s' and file '%s' we expected '%s' but got '%s'", tc.template, tc.filename, tc.expected, key)
+		}
+	}
+}
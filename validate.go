@@ -0,0 +1,278 @@
+package caddys3proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	caddy "github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// How long the startup probe may take
+const startupProbeTimeout = 10 * time.Second
+
+// See: https://docs.aws.amazon.com/AmazonS3/latest/userguide/bucketnamingrules.html
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// Older us-east-1 buckets, and S3-compatible stores like MinIO, also allow uppercase letters,
+// underscores and up to 255 characters
+var legacyBucketNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,255}$`)
+
+// validBucketName checks a bucket name against the S3 naming rules. Names with placeholders are
+// only known per request, so they are not checked.
+func validBucketName(name string) error {
+	if hasPlaceholder(name) {
+		return nil
+	}
+	if !bucketNamePattern.MatchString(name) {
+		return fmt.Errorf("bucket name '%s' must be 3 to 63 lowercase letters, digits, dots or hyphens, starting and ending with a letter or digit", name)
+	}
+	if strings.Contains(name, "..") {
+		return fmt.Errorf("bucket name '%s' must not have two dots in a row", name)
+	}
+	if net.ParseIP(name) != nil {
+		return fmt.Errorf("bucket name '%s' must not be an IP address", name)
+	}
+	if strings.HasPrefix(name, "xn--") || strings.HasSuffix(name, "-s3alias") || strings.HasSuffix(name, "--ol-s3") {
+		return fmt.Errorf("bucket name '%s' uses a reserved prefix or suffix", name)
+	}
+	return nil
+}
+
+// checkBucketName fails on bucket names that break the S3 naming rules, unless the bucket may be an
+// older us-east-1 bucket or is on a custom endpoint. Those only need to be valid legacy names, and
+// breaking the current rules is logged.
+func (p *S3Proxy) checkBucketName(name string, region string, endpoint string) error {
+	err := validBucketName(name)
+	legacy := endpoint != "" || region == "" || region == "us-east-1"
+	if err == nil || !legacy {
+		return err
+	}
+	if !legacyBucketNamePattern.MatchString(name) {
+		return fmt.Errorf("bucket name '%s' must be 3 to 255 letters, digits, dots, hyphens or underscores", name)
+	}
+	if p.log != nil {
+		p.log.Warn("bucket name breaks the S3 naming rules",
+			zap.String("bucket", name),
+			zap.String("err", err.Error()),
+		)
+	}
+	return nil
+}
+
+// Validate checks the config for mistakes that would otherwise only show up as errors on requests.
+// It also runs the startup probe when that is turned on.
+func (p *S3Proxy) Validate() error {
+	endpoint := p.Endpoint
+	if len(p.Endpoints) > 0 {
+		endpoint = p.Endpoints[0]
+	}
+	if err := p.checkBucketName(p.Bucket, p.Region, endpoint); err != nil {
+		return err
+	}
+	for _, overlay := range p.Overlays {
+		if err := p.checkBucketName(overlay.Bucket, p.Region, endpoint); err != nil {
+			return fmt.Errorf("overlay: %v", err)
+		}
+	}
+	if p.Replica != nil {
+		replicaRegion, replicaEndpoint := p.Replica.Region, p.Replica.Endpoint
+		if replicaRegion == "" {
+			replicaRegion = p.Region
+		}
+		if replicaEndpoint == "" {
+			replicaEndpoint = endpoint
+		}
+		if err := p.checkBucketName(p.Replica.Bucket, replicaRegion, replicaEndpoint); err != nil {
+			return fmt.Errorf("replica: %v", err)
+		}
+		if p.Replica.Bucket == p.Bucket && p.Replica.Region == "" && p.Replica.Endpoint == "" {
+			return fmt.Errorf("replica is the same bucket as '%s'", p.Bucket)
+		}
+	}
+
+	// The endpoint decides which host gets signed requests, it must not be picked by clients
+	if hasRequestPlaceholder(p.Endpoint) {
+		return fmt.Errorf("endpoint '%s' can not have request placeholders", p.Endpoint)
+	}
+	if err := p.validateEndpoints(); err != nil {
+		return err
+	}
+	if p.Credentials != nil {
+		if err := p.Credentials.validate(); err != nil {
+			return fmt.Errorf("credentials: %v", err)
+		}
+	}
+
+	if p.Transport != nil {
+		if err := p.Transport.validate(); err != nil {
+			return fmt.Errorf("transport: %v", err)
+		}
+	}
+
+	if p.Presign != nil {
+		if len(p.Presign.Tokens) == 0 {
+			return errors.New("presign needs at least one token")
+		}
+		if !p.EnablePut {
+			return errors.New("presign needs enable_put")
+		}
+	}
+
+	if p.EnableContentAddressed && !p.EnablePut {
+		return errors.New("content_addressed needs enable_put")
+	}
+
+	if p.SignedURLs != nil && p.SignedURLs.IssuePath != "" && len(p.SignedURLs.AdminTokens) == 0 {
+		return errors.New("signed_urls issue_path needs at least one admin_token")
+	}
+
+	for code, page := range p.ErrorPages {
+		if code < 400 || code > 599 {
+			return fmt.Errorf("error page status %d is not a 4xx or 5xx", code)
+		}
+		if page == "" {
+			return fmt.Errorf("error page for status %d is empty", code)
+		}
+	}
+
+	for _, pattern := range p.Hide {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("hide pattern '%s' is not valid: %v", pattern, err)
+		}
+	}
+
+	if p.BrowseTemplate != "" && !p.EnableBrowse {
+		return errors.New("browse template is set but browse is not enabled")
+	}
+	if p.DeployConcurrency < 0 {
+		return errors.New("deploy concurrency can not be negative")
+	}
+	if p.DeployMaxSize < 0 || p.DeployMaxExtract < 0 {
+		return errors.New("deploy sizes can not be negative")
+	}
+	if (p.HealthCanary != "" || p.HealthInterval != 0) && p.HealthPath == "" {
+		return errors.New("health canary and interval need a health path")
+	}
+	if p.ParallelGet != nil && (p.ParallelGet.Threshold < 0 || p.ParallelGet.PartSize < 0 || p.ParallelGet.Concurrency < 0) {
+		return errors.New("parallel get sizes and concurrency can not be negative")
+	}
+	if p.ChunkCache != nil && (p.ChunkCache.Size <= 0 || p.ChunkCache.ChunkSize < 0) {
+		return errors.New("chunk cache size must be set and chunk size can not be negative")
+	}
+	if p.NotFoundCache != nil && (p.NotFoundCache.TTL < 0 || p.NotFoundCache.MaxEntries < 0) {
+		return errors.New("not found cache ttl and max entries can not be negative")
+	}
+	if p.Hedge != nil && (p.Hedge.Budget < 0 || p.Hedge.Budget > 1) {
+		return errors.New("hedge budget must be between 0 and 1")
+	}
+	if p.CircuitBreaker != nil {
+		if p.CircuitBreaker.ErrorRatio < 0 || p.CircuitBreaker.ErrorRatio > 1 {
+			return errors.New("circuit breaker error ratio must be between 0 and 1")
+		}
+		if p.CircuitBreaker.StaleCacheSize < 0 || p.CircuitBreaker.StaleMaxObjectSize < 0 {
+			return errors.New("stale cache sizes can not be negative")
+		}
+	}
+
+	// Endpoints at fixed paths must not shadow each other
+	paths := make(map[string]string)
+	for _, endpoint := range [][2]string{
+		{"presign", p.presignPath()},
+		{"signed_urls issue_path", p.signedURLIssuePath()},
+		{"health", p.HealthPath},
+	} {
+		option, endpointPath := endpoint[0], endpoint[1]
+		if endpointPath == "" {
+			continue
+		}
+		if other, ok := paths[endpointPath]; ok {
+			return fmt.Errorf("%s and %s both use the path %s", other, option, endpointPath)
+		}
+		paths[endpointPath] = option
+	}
+
+	if p.StartupProbe {
+		return p.probeOnStartup()
+	}
+	return nil
+}
+
+func (p S3Proxy) presignPath() string {
+	if p.Presign == nil {
+		return ""
+	}
+	return p.Presign.Path
+}
+
+func (p S3Proxy) signedURLIssuePath() string {
+	if p.SignedURLs == nil {
+		return ""
+	}
+	return p.SignedURLs.IssuePath
+}
+
+// probeOnStartup checks that the bucket exists and the credentials work, so a bad config fails
+// to load instead of failing requests.
+func (p S3Proxy) probeOnStartup() error {
+	if hasPlaceholder(p.Bucket) || hasPlaceholder(p.Region) || hasPlaceholder(p.Endpoint) {
+		p.log.Warn("skipping startup probe, the bucket is only known per request",
+			zap.String("bucket", p.Bucket),
+		)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), startupProbeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := p.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(p.Bucket),
+	}); err != nil {
+		return fmt.Errorf("startup probe: can not reach bucket '%s': %v", p.Bucket, startupProbeError(err))
+	}
+
+	if p.StartupProbeList {
+		if _, err := p.client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket:  aws.String(p.Bucket),
+			MaxKeys: aws.Int64(1),
+		}); err != nil {
+			return fmt.Errorf("startup probe: can not list bucket '%s': %v", p.Bucket, startupProbeError(err))
+		}
+	}
+
+	p.log.Info("startup probe passed",
+		zap.String("bucket", p.Bucket),
+		zap.Duration("latency", time.Since(start)),
+	)
+	return nil
+}
+
+// startupProbeError adds a hint to the errors a HEAD request returns, which have no message
+func startupProbeError(err error) error {
+	switch convertToCaddyError(err).StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("bucket does not exist (%v)", err)
+	case http.StatusForbidden:
+		return fmt.Errorf("access denied, check the credentials and bucket policy (%v)", err)
+	}
+	return err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*S3Proxy)(nil)
+	_ caddy.Validator             = (*S3Proxy)(nil)
+	_ caddy.CleanerUpper          = (*S3Proxy)(nil)
+	_ caddyhttp.MiddlewareHandler = (*S3Proxy)(nil)
+)
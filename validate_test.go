@@ -0,0 +1,165 @@
+package caddys3proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+func TestValidBucketName(t *testing.T) {
+	valid := []string{"my-bucket", "abc", "my.bucket.2", "site-{http.request.host.labels.2}"}
+	invalid := []string{"ab", "My-Bucket", "-bucket", "bucket-", "my..bucket", "my_bucket", "192.168.1.1",
+		"xn--bucket", "bucket-s3alias", strings.Repeat("a", 64)}
+
+	for _, name := range valid {
+		if err := validBucketName(name); err != nil {
+			t.Errorf("Expected '%s' to be valid, got %v", name, err)
+		}
+	}
+	for _, name := range invalid {
+		if err := validBucketName(name); err == nil {
+			t.Errorf("Expected '%s' to be invalid", name)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	type testCase struct {
+		name      string
+		proxy     S3Proxy
+		errString string
+	}
+
+	testCases := []testCase{
+		{
+			name:  "valid",
+			proxy: S3Proxy{Bucket: "mybucket", Hide: []string{"*.secret"}, ErrorPages: map[int]string{404: "/404.html"}},
+		},
+		{
+			name:      "bad bucket",
+			proxy:     S3Proxy{Bucket: "My_Bucket", Region: "eu-west-1"},
+			errString: "bucket name 'My_Bucket' must be 3 to 63",
+		},
+		{
+			name:  "legacy us-east-1 bucket",
+			proxy: S3Proxy{Bucket: "My_Bucket"},
+		},
+		{
+			name:  "minio bucket",
+			proxy: S3Proxy{Bucket: "My_Bucket", Region: "eu-west-1", Endpoint: "http://minio:9000"},
+		},
+		{
+			name:      "bad legacy bucket",
+			proxy:     S3Proxy{Bucket: "my bucket"},
+			errString: "bucket name 'my bucket' must be 3 to 255",
+		},
+		{
+			name:      "bad overlay bucket",
+			proxy:     S3Proxy{Bucket: "mybucket", Overlays: []OverlaySource{{Bucket: "x"}}},
+			errString: "overlay: bucket name 'x'",
+		},
+		{
+			name:      "error page status",
+			proxy:     S3Proxy{Bucket: "mybucket", ErrorPages: map[int]string{200: "/ok.html"}},
+			errString: "error page status 200 is not a 4xx or 5xx",
+		},
+		{
+			name:      "hide pattern",
+			proxy:     S3Proxy{Bucket: "mybucket", Hide: []string{"[a-"}},
+			errString: "hide pattern '[a-' is not valid",
+		},
+		{
+			name:      "endpoint from the request",
+			proxy:     S3Proxy{Bucket: "mybucket", Endpoint: "https://{http.request.host}"},
+			errString: "endpoint 'https://{http.request.host}' can not have request placeholders",
+		},
+		{
+			name:      "endpoint policy",
+			proxy:     S3Proxy{Bucket: "mybucket", Endpoints: []string{"http://a:9000", "http://b:9000"}, EndpointPolicy: "fastest"},
+			errString: "endpoint policy 'fastest' must be",
+		},
+		{
+			name:      "same path",
+			proxy:     S3Proxy{Bucket: "mybucket", EnablePut: true, Presign: &PresignConfig{Path: "/api", Tokens: []string{"t"}}, HealthPath: "/api"},
+			errString: "presign and health both use the path /api",
+		},
+		{
+			name:      "presign without tokens",
+			proxy:     S3Proxy{Bucket: "mybucket", EnablePut: true, Presign: &PresignConfig{Path: "/presign"}},
+			errString: "presign needs at least one token",
+		},
+		{
+			name:      "presign without put",
+			proxy:     S3Proxy{Bucket: "mybucket", Presign: &PresignConfig{Path: "/presign", Tokens: []string{"t"}}},
+			errString: "presign needs enable_put",
+		},
+		{
+			name:      "content addressed without put",
+			proxy:     S3Proxy{Bucket: "mybucket", EnableContentAddressed: true},
+			errString: "content_addressed needs enable_put",
+		},
+		{
+			name:      "issue path without admin tokens",
+			proxy:     S3Proxy{Bucket: "mybucket", SignedURLs: &SignedURLConfig{IssuePath: "/share"}},
+			errString: "signed_urls issue_path needs at least one admin_token",
+		},
+		{
+			name:      "replica is the bucket",
+			proxy:     S3Proxy{Bucket: "mybucket", Replica: &ReplicaConfig{Bucket: "mybucket"}},
+			errString: "replica is the same bucket as 'mybucket'",
+		},
+		{
+			name:      "browse template without browse",
+			proxy:     S3Proxy{Bucket: "mybucket", BrowseTemplate: "dir.html"},
+			errString: "browse template is set but browse is not enabled",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.proxy.Validate()
+			if tc.errString == "" {
+				if err != nil {
+					t.Errorf("Unexpected err %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tc.errString) {
+				t.Errorf("Expected err starting with '%s', got %v", tc.errString, err)
+			}
+		})
+	}
+}
+
+func TestStartupProbe(t *testing.T) {
+	client := newS3Client(t)
+	bucketName := setupTestBucket(t, client)
+
+	// Nothing listens on port 1
+	unreachable := s3.New(newStubSession(t, "http://127.0.0.1:1"))
+
+	for _, tc := range []struct {
+		client    *s3.S3
+		shouldErr bool
+	}{
+		{client: client, shouldErr: false},
+		{client: unreachable, shouldErr: true},
+	} {
+		proxy := S3Proxy{
+			Bucket:           bucketName,
+			StartupProbe:     true,
+			StartupProbeList: true,
+			client:           tc.client,
+			log:              zap.NewExample(),
+		}
+		err := proxy.Validate()
+		if tc.shouldErr && (err == nil || !strings.HasPrefix(err.Error(), "startup probe: can not reach bucket")) {
+			t.Errorf("Expected the probe to fail, got %v", err)
+		}
+		if !tc.shouldErr && err != nil {
+			t.Errorf("Unexpected err %v", err)
+		}
+	}
+}